@@ -0,0 +1,79 @@
+package dnsgrab
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ParseNetworks parses networks in CIDR notation like "192.168.0.0/16" for use in Options.AllowedNetworks and
+// Options.DeniedNetworks. Single IPs like "10.0.0.1" are treated as networks containing only that IP.
+func ParseNetworks(networks ...string) ([]*net.IPNet, error) {
+	result := make([]*net.IPNet, 0, len(networks))
+	for _, network := range networks {
+		network = strings.TrimSpace(network)
+		if !strings.Contains(network, "/") {
+			ip := net.ParseIP(network)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid network %q", network)
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				result = append(result, &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)})
+			} else {
+				result = append(result, &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)})
+			}
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q: %w", network, err)
+		}
+		result = append(result, ipNet)
+	}
+	return result, nil
+}
+
+// admits indicates whether the given client may query according to Options.AllowedNetworks and
+// Options.DeniedNetworks. Unknown clients are only admitted if there are no AllowedNetworks.
+func (s *server) admits(ip net.IP) bool {
+	if ip == nil {
+		return len(s.opts.AllowedNetworks) == 0
+	}
+	if containsIP(s.opts.DeniedNetworks, ip) {
+		return false
+	}
+	return len(s.opts.AllowedNetworks) == 0 || containsIP(s.opts.AllowedNetworks, ip)
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// admit checks whether the given query from the given client is admitted based on its source network and
+// Options.RateLimit. It's called before the query is queued, so that clients that flood the server can't crowd out
+// others. If the query isn't admitted, admit returns the REFUSED response to send, which is nil if the query should be
+// dropped.
+func (s *server) admit(b []byte, client net.Addr) (bool, []byte) {
+	if s.admits(clientIP(client)) {
+		if !s.limiter.allowQuery(clientIP(client)) {
+			log.Debugf("Dropping query from %v, which exceeded its rate limit", client)
+			return false, nil
+		}
+		return true, nil
+	}
+	if !s.opts.RefuseDenied {
+		log.Debugf("Dropping query from %v, which isn't in an allowed network", client)
+		return false, nil
+	}
+	if !s.refusalLimiter.allowQuery(clientIP(client)) {
+		log.Debugf("Dropping query from %v, which isn't in an allowed network and exceeded its refusal rate limit", client)
+		return false, nil
+	}
+	log.Debugf("Refusing query from %v, which isn't in an allowed network", client)
+	return false, s.refusal(b)
+}
@@ -1,26 +1,63 @@
 package dnsgrab
 
 import (
+	"context"
 	"errors"
+	"io"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/getlantern/dns"
 	"github.com/getlantern/dnsgrab/internal"
 	"github.com/getlantern/golog"
 	"github.com/getlantern/netx"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
 	maxUDPPacketSize = 512
+
+	// numNameLocks is the number of locks that queries against ThreadSafeCaches are striped across
+	numNameLocks = 256
+
+	// minReceiveBackoff and maxReceiveBackoff bound how long Serve waits before receiving again after an error
+	minReceiveBackoff = 5 * time.Millisecond
+	maxReceiveBackoff = 1 * time.Second
+
+	// DefaultConcurrency is the default number of queries that Serve processes concurrently
+	DefaultConcurrency = 64
+
+	// DefaultQueueDepth is the default number of received queries that wait for processing before Serve starts
+	// refusing queries
+	DefaultQueueDepth = 1024
+
+	// DefaultAllocationInterval is the default interval over which Options.AllocationLimit applies
+	DefaultAllocationInterval = time.Minute
+
+	// DefaultRefusalRateLimit is the number of refusals per second that each client IP gets with Options.RefuseDenied
+	// if there's no Options.RateLimit
+	DefaultRefusalRateLimit = 1
 )
 
 var (
 	log = golog.LoggerFor("dnsgrab")
 
 	ErrUnsupportedQueryType = errors.New("unsupported query type")
+
+	// ErrServerClosed is returned by Serve once the server has been closed or shut down
+	ErrServerClosed = errors.New("dnsgrab: server closed")
+
+	bufferPool = sync.Pool{
+		New: func() interface{} {
+			b := make([]byte, maxUDPPacketSize)
+			return &b
+		},
+	}
 )
 
 // Server is a dns server that resolves queries for A records into fake IP
@@ -30,40 +67,229 @@ type Server interface {
 	// LocalAddr() returns the address at which this server is listening
 	LocalAddr() net.Addr
 
-	// Serve() runs the server (blocks until server ends)
+	// Serve() runs the server (blocks until server ends). It returns ErrServerClosed once the server has been closed or
+	// shut down, and an error wrapping net.ErrClosed if its conn or listener was closed by someone else. Other errors
+	// while receiving queries are logged and retried with increasing delays.
 	Serve() error
 
-	// Close closes the server's network listener.
+	// Close closes the server's network listener. Queries that are still being processed fail to respond.
 	Close() error
 
+	// Shutdown gracefully shuts down the server. It stops receiving queries, waits for queries that have already been
+	// received to be answered, closes the network listener and closes the cache if it's an io.Closer. If ctx is done
+	// before all queries have been answered, the remaining ones fail to respond and Shutdown returns ctx.Err().
+	//
+	// Serve is stopped from receiving by setting a read deadline on its conn. If the conn doesn't support deadlines,
+	// it's closed right away instead, so that queries that have already been received still get processed but fail to
+	// respond.
+	Shutdown(ctx context.Context) error
+
 	// ProcessQuery processes a DNS query and returns the response bytes, the number of answers in the response, and any error encountered while
-	// processing the query.
+	// processing the query. Malformed queries are answered with FORMERR and queries with opcodes other than QUERY with
+	// NOTIMP, while messages that can't be answered at all fail with an error wrapping ErrInvalidQuery.
 	ProcessQuery(b []byte) ([]byte, int, error)
 
+	// ProcessQueryContext is like ProcessQuery but records its spans as children of the span in ctx, if any
+	ProcessQueryContext(ctx context.Context, b []byte) ([]byte, int, error)
+
+	// ProcessPacket processes a DNS query contained in a complete IPv4 or IPv6 UDP packet, as intercepted from a TUN
+	// device, and returns a complete response packet addressed back to the sender with valid checksums. Returns nil if
+	// the query should be dropped, and an error wrapping ErrInvalidPacket if the packet can't be handled.
+	ProcessPacket(packet []byte) ([]byte, error)
+
 	// ReverseLookup resolves the given fake IP address into the original hostname. If the given IP is not a fake IP,
 	// this simply returns the provided IP in string form. If the IP is not found, this returns false.
 	ReverseLookup(ip net.IP) (string, bool)
+
+	// FakeIPFor returns the fake IP for the given hostname, allocating a new one if the name isn't mapped yet. This is
+	// equivalent to issuing an A query for the name, but without a round trip through DNS. Returns nil for empty names.
+	FakeIPFor(name string) (net.IP, error)
+
+	// LookupName returns the fake IP currently mapped to the given hostname without allocating a new one or marking
+	// the existing mapping as fresh. If the name isn't mapped, this returns false.
+	LookupName(name string) (net.IP, bool)
+
+	// Remove removes the mapping for the given hostname, returning false if there was none
+	Remove(name string) (bool, error)
+
+	// RemoveIP removes the mapping for the given fake IP, returning false if there was none
+	RemoveIP(ip net.IP) (bool, error)
+
+	// Flush removes all mappings. Fake IPs handed out before the flush won't be handed out again until the sequence
+	// wraps around.
+	Flush() error
+
+	// Snapshot returns a consistent snapshot of all entries currently in the cache
+	Snapshot() ([]Entry, error)
+
+	// Export writes all mappings and the current sequence to w in the given format
+	Export(w io.Writer, format ExportFormat) error
+
+	// Import replaces all mappings and the current sequence with previously exported ones read from r in the given
+	// format. Nothing is changed if the export read from r is invalid.
+	Import(r io.Reader, format ExportFormat) error
+
+	// Subscribe registers a handler that gets called whenever a name is mapped, refreshed, evicted, expired or
+	// reassigned. Handlers are called synchronously from the goroutine that caused the change, possibly concurrently
+	// and possibly while the server holds its lock, so they must return quickly and must not call back into the Server.
+	// Calling the returned function unsubscribes the handler.
+	Subscribe(handler func(Event)) (unsubscribe func())
 }
 
-// Cache defines the API for a cache of names to IPs and vice versa
+// Cache defines the API for a cache of names to IPs and vice versa. Errors returned by a Cache cause the affected DNS
+// queries to fail with SERVFAIL. Unless the Cache is a ThreadSafeCache, the server never calls it concurrently, so
+// lookups may change its state.
 type Cache interface {
-	NameByIP(ip []byte) (name string, found bool)
+	NameByIP(ip []byte) (name string, found bool, err error)
+
+	IPByName(name string) (ip []byte, found bool, err error)
+
+	Add(name string, ip []byte) error
+
+	MarkFresh(name string, ip []byte) error
+
+	NextSequence() (uint32, error)
+
+	// Sequence returns the value that the next call to NextSequence will return
+	Sequence() (uint32, error)
 
-	IPByName(name string) (ip []byte, found bool)
+	// SetSequence sets the value that the next call to NextSequence will return
+	SetSequence(next uint32) error
 
-	Add(name string, ip []byte)
+	// Restore adds a mapping that was last marked fresh at the given time, for example when importing a previously
+	// exported cache
+	Restore(name string, ip []byte, fresh time.Time) error
 
-	MarkFresh(name string, ip []byte)
+	// Range calls fn for every entry in the cache until fn returns false. fresh is the time at which the entry was
+	// added or last marked fresh. The order in which entries are visited depends on the implementation.
+	Range(fn func(name string, ip []byte, fresh time.Time) bool) error
 
-	NextSequence() uint32
+	// Remove removes the mapping for the given name, returning the IP it was mapped to
+	Remove(name string) (ip []byte, found bool, err error)
+
+	// RemoveIP removes the mapping for the given IP, returning the name it was mapped to
+	RemoveIP(ip []byte) (name string, found bool, err error)
+
+	// Flush removes all mappings without resetting the sequence
+	Flush() error
+}
+
+// Entry is a single mapping between a name and its fake IP
+type Entry struct {
+	Name string
+	IP   net.IP
+
+	// Fresh is the time at which the mapping was added or last marked fresh
+	Fresh time.Time
+}
+
+// Options configures a server
+type Options struct {
+	// Concurrency is the number of queries that Serve processes concurrently, or for servers created with
+	// NewWithListener, the number of connections. If zero or negative, DefaultConcurrency is used.
+	Concurrency int
+
+	// QueueDepth is the number of received queries that wait for processing once all workers are busy. Queries
+	// received while the queue is full are answered with REFUSED. If zero or negative, DefaultQueueDepth is used.
+	QueueDepth int
+
+	// Metrics receives measurements about queries, the cache and upstream DNS servers. If nil, nothing is measured.
+	Metrics Metrics
+
+	// TracerProvider provides the tracer used to record spans for processing queries. If nil, the global
+	// TracerProvider is used.
+	TracerProvider trace.TracerProvider
+
+	// QueryLog receives an entry for every processed query. If nil, queries aren't logged.
+	QueryLog QueryLogger
+
+	// QueryLogSampleRate is the fraction of queries that are logged to QueryLog, between 0 and 1. If zero, all
+	// queries are logged.
+	QueryLogSampleRate float64
+
+	// QueryLogRedaction controls what's left out of entries logged to QueryLog
+	QueryLogRedaction Redaction
+
+	// PrivacyKey enables privacy mode, in which names are replaced by a keyed hash of the name in log output, spans and
+	// QueryLog entries, and queries and responses are left out of QueryLog entries. Entries about the same name can
+	// still be correlated without revealing it, as long as the key is kept secret. Use an encrypted cache like one
+	// from persistentcache with Options.Key to keep names from being stored in plaintext too.
+	PrivacyKey []byte
+
+	// RateLimit is the number of queries per second that each client IP may send on average. Queries beyond that are
+	// dropped. If zero or negative, queries aren't rate limited. Limits only apply to queries received by Serve or
+	// passed to ProcessPacket, since ProcessQuery doesn't know the client. IPv6 clients within the same /64 network
+	// share their limits.
+	RateLimit float64
+
+	// RateBurst is the number of queries that each client IP may send at once before RateLimit kicks in. If zero or
+	// negative, it's the same as RateLimit.
+	RateBurst int
+
+	// AllocationLimit is the number of new fake IPs that each client IP may have allocated per AllocationInterval, so
+	// that a single client can't exhaust the fake IP range and evict everyone else's mappings by querying random names.
+	// Questions that would need a new fake IP beyond that are answered with REFUSED, while questions for names that
+	// already have one are still answered. If zero or negative, allocations aren't limited.
+	AllocationLimit int
+
+	// AllocationInterval is the interval over which AllocationLimit applies. If zero or negative,
+	// DefaultAllocationInterval is used.
+	AllocationInterval time.Duration
+
+	// AllowedNetworks are the networks that clients may query from. Queries from anywhere else are dropped, including
+	// queries from clients whose IP is unknown because they're received through a conn with unusual addresses. If
+	// empty, clients may query from anywhere that isn't in DeniedNetworks. Like the rate limits, the source networks
+	// don't apply to ProcessQuery. See ParseNetworks for building them from strings.
+	AllowedNetworks []*net.IPNet
+
+	// DeniedNetworks are the networks that clients may not query from, even if they're within AllowedNetworks
+	DeniedNetworks []*net.IPNet
+
+	// RefuseDenied answers queries from clients outside of AllowedNetworks or inside of DeniedNetworks with REFUSED.
+	// By default, they're silently dropped, which doesn't let scanners know that there's a DNS server. So that the
+	// server can't be used to reflect traffic at spoofed source addresses, each client IP only gets RateLimit refusals
+	// per second, or DefaultRefusalRateLimit if there's no RateLimit, and queries beyond that are dropped.
+	RefuseDenied bool
+}
+
+// packet is a query received by Serve. b is borrowed from bufferPool.
+type packet struct {
+	b          *[]byte
+	n          int
+	remoteAddr net.Addr
 }
 
 type server struct {
 	cache            Cache
 	defaultDNSServer func() string
-	conn             *net.UDPConn
+	conn             net.PacketConn
+	listener         net.Listener
 	client           *dns.Client
+	subscribers      subscribers
+	opts             Options
+	queue            chan *packet
+	metrics          Metrics
+	tracer           trace.Tracer
+	limiter          *clientLimiter
+	refusalLimiter   *clientLimiter
 	mx               sync.RWMutex
+
+	// unwrapped indicates that the cache's sequence starts at the beginning of the fake IP range without having
+	// wrapped around, so the next allocation of internal.MinIP isn't a wrap-around
+	unwrapped atomic.Bool
+
+	// lifecycle
+	serving      bool
+	closing      chan interface{}
+	served       chan interface{}
+	lifecycleMx  sync.Mutex
+	closingOnce  sync.Once
+	cacheClosing sync.Once
+
+	// threadSafe indicates that the cache is a ThreadSafeCache, in which case queries only hold mx for reading and
+	// lock the name they're allocating a fake IP for instead
+	threadSafe bool
+	nameLocks  [numNameLocks]sync.Mutex
 }
 
 // Listen creates a new server listening at the given listenAddr and that
@@ -75,6 +301,47 @@ func Listen(cacheSize int, listenAddr string, defaultDNSServer func() string) (S
 
 // ListenWithCache is like Listen but taking any Cache implementation.
 func ListenWithCache(listenAddr string, defaultDNSServer func() string, cache Cache) (Server, error) {
+	return ListenWithOptions(listenAddr, defaultDNSServer, cache, &Options{})
+}
+
+// ListenWithOptions is like ListenWithCache but with additional Options. nil opts are the same as empty ones.
+func ListenWithOptions(listenAddr string, defaultDNSServer func() string, cache Cache, opts *Options) (Server, error) {
+	addr, err := net.ResolveUDPAddr("udp4", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debugf("Listening at: %v", conn.LocalAddr())
+	return NewWithPacketConn(conn, defaultDNSServer, cache, opts), nil
+}
+
+// NewWithPacketConn creates a server that receives queries on an existing conn, for example one obtained through
+// socket activation or from a userspace network stack. The server takes ownership of conn and closes it when it's
+// closed. Shutdown only drains in-flight queries gracefully if conn supports SetReadDeadline.
+func NewWithPacketConn(conn net.PacketConn, defaultDNSServer func() string, cache Cache, opts *Options) Server {
+	s := newServer(defaultDNSServer, cache, opts)
+	s.conn = conn
+	return s
+}
+
+// NewWithListener creates a server that accepts DNS over TCP connections from an existing listener. Queries on each
+// connection are processed one at a time, while up to Options.Concurrency connections are processed concurrently.
+// Further connections aren't accepted until others are closed. The server takes ownership of the listener and closes
+// it when it's closed.
+func NewWithListener(l net.Listener, defaultDNSServer func() string, cache Cache, opts *Options) Server {
+	s := newServer(defaultDNSServer, cache, opts)
+	s.listener = l
+	return s
+}
+
+func newServer(defaultDNSServer func() string, cache Cache, opts *Options) *server {
+	if opts == nil {
+		opts = &Options{}
+	}
 	s := &server{
 		cache:            cache,
 		defaultDNSServer: defaultDNSServer,
@@ -82,19 +349,54 @@ func ListenWithCache(listenAddr string, defaultDNSServer func() string, cache Ca
 			ReadTimeout: 2 * time.Second,
 			CustomDial:  netx.DialTimeout,
 		},
+		opts:    *opts,
+		closing: make(chan interface{}),
+		served:  make(chan interface{}),
 	}
-
-	addr, err := net.ResolveUDPAddr("udp4", listenAddr)
-	if err != nil {
-		return nil, err
+	if s.opts.Concurrency <= 0 {
+		s.opts.Concurrency = DefaultConcurrency
 	}
-	s.conn, err = net.ListenUDP("udp4", addr)
-	if err != nil {
-		return nil, err
+	if s.opts.QueueDepth <= 0 {
+		s.opts.QueueDepth = DefaultQueueDepth
+	}
+	s.queue = make(chan *packet, s.opts.QueueDepth)
+	s.limiter = newClientLimiter(&s.opts)
+	if s.opts.RefuseDenied {
+		refusalRate := s.opts.RateLimit
+		if refusalRate <= 0 {
+			refusalRate = DefaultRefusalRateLimit
+		}
+		s.refusalLimiter = newClientLimiter(&Options{RateLimit: refusalRate, RateBurst: s.opts.RateBurst})
 	}
 
-	log.Debugf("Listening at: %v", s.conn.LocalAddr())
-	return s, nil
+	if threadSafe, ok := cache.(ThreadSafeCache); ok {
+		s.threadSafe = threadSafe.ThreadSafe()
+	}
+	if sequence, err := cache.Sequence(); err == nil {
+		s.unwrapped.Store(sequence == internal.MinIP)
+	}
+	if notifier, ok := cache.(EvictionNotifier); ok {
+		notifier.OnEvicted(func(name string, ip []byte) {
+			s.subscribers.emit(EventEvicted, name, ip)
+		})
+	}
+	if notifier, ok := cache.(ExpirationNotifier); ok {
+		notifier.OnExpired(func(name string, ip []byte) {
+			s.subscribers.emit(EventExpired, name, ip)
+		})
+	}
+	tracerProvider := s.opts.TracerProvider
+	if tracerProvider == nil {
+		tracerProvider = otel.GetTracerProvider()
+	}
+	s.tracer = tracerProvider.Tracer(tracerName)
+	s.metrics = s.opts.Metrics
+	if s.metrics == nil {
+		s.metrics = noopMetrics{}
+	} else {
+		s.trackCacheSize()
+	}
+	return s
 }
 
 func (s *server) getDefaultDNSServer() string {
@@ -108,59 +410,421 @@ func (s *server) getDefaultDNSServer() string {
 }
 
 func (s *server) LocalAddr() net.Addr {
+	if s.listener != nil {
+		return s.listener.Addr()
+	}
 	return s.conn.LocalAddr()
 }
 
 func (s *server) Serve() error {
-	b := make([]byte, maxUDPPacketSize)
+	s.lifecycleMx.Lock()
+	if s.isClosing() || s.serving {
+		s.lifecycleMx.Unlock()
+		return ErrServerClosed
+	}
+	s.serving = true
+	s.lifecycleMx.Unlock()
+
+	if s.listener != nil {
+		defer close(s.served)
+		return s.serveListener()
+	}
+
+	var workers sync.WaitGroup
+	for i := 0; i < s.opts.Concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			s.work()
+		}()
+	}
+	defer func() {
+		// let workers finish the queries that were already received
+		close(s.queue)
+		workers.Wait()
+		close(s.served)
+	}()
+
+	var backoff time.Duration
 	for {
-		n, remoteAddr, err := s.conn.ReadFromUDP(b)
+		// every packet gets its own buffer, which is returned to the pool once the query has been handled
+		b := bufferPool.Get().(*[]byte)
+		n, remoteAddr, err := s.conn.ReadFrom(*b)
 		if err != nil {
-			if !strings.Contains(err.Error(), "use of closed") {
-				log.Error(err)
+			bufferPool.Put(b)
+			if s.isClosing() {
+				return ErrServerClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			backoff = nextBackoff(backoff)
+			log.Errorf("Error receiving DNS query, retrying in %v: %v", backoff, err)
+			if !s.sleep(backoff) {
+				return ErrServerClosed
 			}
 			continue
 		}
-		go s.handle(b[:n], remoteAddr)
+		backoff = 0
+		p := &packet{b: b, n: n, remoteAddr: remoteAddr}
+		if admitted, refusal := s.admit((*b)[:n], remoteAddr); !admitted {
+			if refusal != nil {
+				if _, err := s.conn.WriteTo(refusal, remoteAddr); err != nil {
+					log.Errorf("Error refusing DNS query: %v", err)
+				}
+			}
+			bufferPool.Put(b)
+			continue
+		}
+		select {
+		case s.queue <- p:
+		default:
+			// all workers are busy and the queue is full, shed load
+			s.refuse(p)
+		}
+	}
+}
+
+// nextBackoff doubles the given backoff within minReceiveBackoff and maxReceiveBackoff
+func nextBackoff(backoff time.Duration) time.Duration {
+	backoff *= 2
+	if backoff < minReceiveBackoff {
+		backoff = minReceiveBackoff
+	}
+	if backoff > maxReceiveBackoff {
+		backoff = maxReceiveBackoff
+	}
+	return backoff
+}
+
+// sleep waits for the given duration, returning false if the server started closing in the meantime
+func (s *server) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-s.closing:
+		return false
+	}
+}
+
+func (s *server) work() {
+	for p := range s.queue {
+		s.handle((*p.b)[:p.n], p.remoteAddr)
+		bufferPool.Put(p.b)
 	}
 }
 
+// refuse answers the given query with REFUSED because the server is too busy
+func (s *server) refuse(p *packet) {
+	defer bufferPool.Put(p.b)
+	bo := s.refusal((*p.b)[:p.n])
+	if bo == nil {
+		return
+	}
+	log.Debugf("Too busy, refusing query from %v", p.remoteAddr)
+	if _, err := s.conn.WriteTo(bo, p.remoteAddr); err != nil {
+		log.Errorf("Error refusing DNS query: %v", err)
+	}
+}
+
+// refusal returns a packed REFUSED response to the given query, or nil if the query can't be parsed or isn't a query
+func (s *server) refusal(b []byte) []byte {
+	if checkHeader(b) != nil {
+		return nil
+	}
+	msgIn := &dns.Msg{}
+	if err := msgIn.Unpack(b); err != nil {
+		return nil
+	}
+	for _, question := range msgIn.Question {
+		_, span := s.startQuestionSpan(context.Background(), question)
+		s.questionHandled(span, nil, question, OutcomeRefused, nil)
+		span.End()
+	}
+	msgOut := &dns.Msg{}
+	msgOut.SetRcode(msgIn, dns.RcodeRefused)
+	bo, err := msgOut.Pack()
+	if err != nil {
+		log.Error(err)
+		return nil
+	}
+	return bo
+}
+
 func (s *server) Close() error {
+	s.markClosing()
+	return s.closeConn()
+}
+
+func (s *server) closeConn() error {
+	if s.listener != nil {
+		return s.listener.Close()
+	}
 	return s.conn.Close()
 }
 
+func (s *server) Shutdown(ctx context.Context) error {
+	s.lifecycleMx.Lock()
+	s.markClosing()
+	serving := s.serving
+	s.lifecycleMx.Unlock()
+
+	var err error
+	if serving {
+		// unblock Serve so that it notices that we're shutting down
+		if s.listener != nil {
+			s.listener.Close()
+		} else if deadlineErr := s.conn.SetReadDeadline(time.Now()); deadlineErr != nil {
+			log.Debugf("Unable to stop receiving queries with a deadline, closing conn instead: %v", deadlineErr)
+			s.conn.Close()
+		}
+		select {
+		case <-s.served:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	if closeErr := s.closeConn(); closeErr != nil && !errors.Is(closeErr, net.ErrClosed) && err == nil {
+		err = closeErr
+	}
+	if closer, ok := s.cache.(io.Closer); ok {
+		s.cacheClosing.Do(func() {
+			if closeErr := closer.Close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+		})
+	}
+	return err
+}
+
+func (s *server) markClosing() {
+	s.closingOnce.Do(func() {
+		close(s.closing)
+	})
+}
+
+func (s *server) isClosing() bool {
+	select {
+	case <-s.closing:
+		return true
+	default:
+		return false
+	}
+}
+
 func (s *server) ReverseLookup(ip net.IP) (string, bool) {
 	// grab the last 4 bytes of the IP to account for fake IPv6 addresses
 	ipInt := internal.IPToInt(ip[len(ip)-4:])
 	if ipInt < internal.MinIP || ipInt > internal.MaxIP {
 		return ip.String(), true
 	}
-	s.mx.RLock()
-	result, found := s.cache.NameByIP(ip.To4())
-	s.mx.RUnlock()
+	lookupLock := s.lookupLock()
+	lookupLock.Lock()
+	result, found, err := s.cache.NameByIP(ip.To4())
+	lookupLock.Unlock()
+	if err != nil {
+		log.Errorf("Unable to reverse lookup %v: %v", ip, err)
+		return "", false
+	}
 	if !found {
 		return "", false
 	}
 	return result, true
 }
 
+// lookupLock returns the lock to hold while looking up the cache. Lookups of ThreadSafeCaches can proceed concurrently,
+// while other caches may change their state on lookup, for example by removing expired entries, so their lookups are
+// serialized like changes.
+func (s *server) lookupLock() sync.Locker {
+	if s.threadSafe {
+		return s.mx.RLocker()
+	}
+	return &s.mx
+}
+
+func (s *server) FakeIPFor(name string) (net.IP, error) {
+	return s.getCachedFakeIP(context.Background(), name)
+}
+
+func (s *server) LookupName(name string) (net.IP, bool) {
+	ip := s.peekCachedFakeIP(name)
+	return ip, ip != nil
+}
+
+func (s *server) Remove(name string) (bool, error) {
+	name = normalizeName(name)
+	if name == "" {
+		return false, nil
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	ip, found, err := s.cache.Remove(name)
+	if err != nil {
+		return false, err
+	}
+	if found {
+		s.subscribers.emit(EventRemoved, name, ip)
+	}
+	return found, nil
+}
+
+func (s *server) RemoveIP(ip net.IP) (bool, error) {
+	if len(ip) < net.IPv4len {
+		return false, nil
+	}
+	// grab the last 4 bytes of the IP to account for fake IPv6 addresses
+	ip = ip[len(ip)-net.IPv4len:]
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	name, found, err := s.cache.RemoveIP(ip)
+	if err != nil {
+		return false, err
+	}
+	if found {
+		s.subscribers.emit(EventRemoved, name, ip)
+	}
+	return found, nil
+}
+
+func (s *server) Flush() error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if err := s.cache.Flush(); err != nil {
+		return err
+	}
+	s.subscribers.emit(EventFlushed, "", nil)
+	return nil
+}
+
+func (s *server) Snapshot() ([]Entry, error) {
+	lookupLock := s.lookupLock()
+	lookupLock.Lock()
+	defer lookupLock.Unlock()
+	return entriesOf(s.cache)
+}
+
+func (s *server) Export(w io.Writer, format ExportFormat) error {
+	lookupLock := s.lookupLock()
+	lookupLock.Lock()
+	entries, err := entriesOf(s.cache)
+	if err != nil {
+		lookupLock.Unlock()
+		return err
+	}
+	sequence, err := s.cache.Sequence()
+	lookupLock.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeExport(w, format, sequence, entries)
+}
+
+func (s *server) Import(r io.Reader, format ExportFormat) error {
+	sequence, entries, err := readExport(r, format)
+	if err != nil {
+		return err
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if err := restore(s.cache, sequence, entries); err != nil {
+		return err
+	}
+	s.unwrapped.Store(sequence == internal.MinIP)
+	// only report entries that the cache kept, since it may have evicted some of them while restoring
+	restored, err := entriesOf(s.cache)
+	if err != nil {
+		return err
+	}
+	s.subscribers.emit(EventFlushed, "", nil)
+	for i := len(restored) - 1; i >= 0; i-- {
+		s.subscribers.emit(EventMapped, restored[i].Name, restored[i].IP.To4())
+	}
+	return nil
+}
+
+func entriesOf(cache Cache) ([]Entry, error) {
+	var entries []Entry
+	err := cache.Range(func(name string, ip []byte, fresh time.Time) bool {
+		entries = append(entries, Entry{Name: name, IP: copyIP(ip), Fresh: fresh})
+		return true
+	})
+	return entries, err
+}
+
+func (s *server) Subscribe(handler func(Event)) func() {
+	return s.subscribers.subscribe(handler)
+}
+
 func (s *server) ProcessQuery(b []byte) ([]byte, int, error) {
-	msgIn := &dns.Msg{}
-	msgIn.Unpack(b)
+	return s.ProcessQueryContext(context.Background(), b)
+}
 
-	if len(msgIn.Question) == 0 {
-		// TODO: forward the message upstream
+func (s *server) ProcessQueryContext(ctx context.Context, b []byte) ([]byte, int, error) {
+	entry := s.newQueryLogEntry(nil, "")
+	msgOut, err := s.processQuery(ctx, b, entry)
+	if err != nil {
+		s.logQuery(entry, b, nil)
+		return nil, 0, err
 	}
+	out, err := msgOut.Pack()
+	s.logQuery(entry, b, out)
+	return out, len(msgOut.Answer), err
+}
+
+// processQuery processes the given query, recording how it was handled in entry unless that's nil
+func (s *server) processQuery(ctx context.Context, b []byte, entry *QueryLogEntry) (*dns.Msg, error) {
+	ctx, span := s.tracer.Start(ctx, "dnsgrab.ProcessQuery")
+	defer span.End()
 
+	msgIn, rcode, err := validateQuery(b)
+	if err != nil {
+		recordError(span, err)
+		return nil, err
+	}
 	msgOut := &dns.Msg{}
 	msgOut.Response = true
 	msgOut.Id = msgIn.Id
+	msgOut.Opcode = msgIn.Opcode
+	msgOut.RecursionDesired = msgIn.RecursionDesired
+	if rcode != dns.RcodeSuccess {
+		log.Debugf("Rejecting invalid query with %v", dns.RcodeToString[rcode])
+		msgOut.Rcode = rcode
+		if entry != nil {
+			entry.Rcode = rcode
+		}
+		span.SetStatus(codes.Error, dns.RcodeToString[rcode])
+		return msgOut, nil
+	}
+	span.SetAttributes(attrQuestionCount.Int(len(msgIn.Question)))
 	msgOut.Question = msgIn.Question
 	var unansweredQuestions []dns.Question
 
 	for _, question := range msgIn.Question {
-		answer := s.processQuestion(question)
+		questionCtx, questionSpan := s.startQuestionSpan(ctx, question)
+		answer, err := s.processQuestion(questionCtx, question)
+		if err != nil {
+			outcome, rcode := OutcomeFailed, dns.RcodeServerFailure
+			if errors.Is(err, ErrAllocationLimited) {
+				log.Debugf("Refusing question %v: %v", s.loggableQuestions(question), err)
+				outcome, rcode = OutcomeRefused, dns.RcodeRefused
+			} else {
+				log.Errorf("Unable to process question %v, responding with SERVFAIL: %v", s.loggableQuestions(question), err)
+				recordError(questionSpan, err)
+			}
+			s.questionHandled(questionSpan, entry, question, outcome, nil)
+			questionSpan.End()
+			msgOut.Answer = nil
+			msgOut.Rcode = rcode
+			if entry != nil {
+				entry.Rcode = msgOut.Rcode
+				entry.Err = err.Error()
+			}
+			return msgOut, nil
+		}
 		if answer != nil {
+			s.questionHandled(questionSpan, entry, question, OutcomeGrabbed, answer)
 			msgOut.Answer = append(msgOut.Answer, answer)
 		} else {
 			if question.Qtype == dns.TypeSVCB || question.Qtype == dns.TypeHTTPS {
@@ -169,58 +833,114 @@ func (s *server) ProcessQuery(b []byte) ([]byte, int, error) {
 				// clients using the answers from a real DNS server (which may be poisoned or return IPs that aren't well optimized
 				// for use on our proxies), we simply drop these queries
 				// See https://svn.tools.ietf.org/id/draft-ietf-dnsop-svcb-https-00.xml#client-behavior
-				continue
+				s.questionHandled(questionSpan, entry, question, OutcomeDropped, nil)
+			} else {
+				s.questionHandled(questionSpan, entry, question, OutcomeForwarded, nil)
+				unansweredQuestions = append(unansweredQuestions, question)
 			}
-			unansweredQuestions = append(unansweredQuestions, question)
 		}
+		questionSpan.End()
 	}
 
 	if len(unansweredQuestions) > 0 {
-		log.Debugf("Passing unanswered questions along: %v", unansweredQuestions)
+		log.Debugf("Passing unanswered questions along: %v", s.loggableQuestions(unansweredQuestions...))
 		msgIn.Question = unansweredQuestions
-		resp, _, err := s.client.Exchange(msgIn, s.getDefaultDNSServer())
+		upstream := s.getDefaultDNSServer()
+		_, upstreamSpan := s.tracer.Start(ctx, "dnsgrab.upstream", trace.WithAttributes(attrUpstream.String(upstream)))
+		start := time.Now()
+		resp, _, err := s.client.Exchange(msgIn, upstream)
+		elapsed := time.Since(start)
+		s.metrics.UpstreamExchanged(upstream, elapsed, err)
+		if entry != nil {
+			entry.Upstream = upstream
+			entry.UpstreamDuration = elapsed
+		}
 		if err != nil {
-			return nil, 0, err
+			if entry != nil {
+				entry.Err = err.Error()
+			}
+			recordError(upstreamSpan, err)
+			upstreamSpan.End()
+			recordError(span, err)
+			return nil, err
 		}
+		upstreamSpan.SetAttributes(attrAnswerCount.Int(len(resp.Answer)))
+		upstreamSpan.End()
 		msgOut.Answer = append(msgOut.Answer, resp.Answer...)
 	}
 
-	out, err := msgOut.Pack()
-	return out, len(msgOut.Answer), err
+	if entry != nil {
+		entry.Rcode = msgOut.Rcode
+	}
+	return msgOut, nil
+}
+
+// questionHandled records how a question was handled in metrics, on the question's span and in entry unless that's
+// nil
+func (s *server) questionHandled(span trace.Span, entry *QueryLogEntry, question dns.Question, outcome Outcome, answer dns.RR) {
+	s.metrics.QuestionHandled(qtypeLabel(question.Qtype), outcome)
+	span.SetAttributes(attrOutcome.String(outcome.String()))
+	entry.logQuestion(question, outcome, answer)
 }
 
-func (s *server) handle(b []byte, remoteAddr *net.UDPAddr) {
-	bo, numAnswers, err := s.ProcessQuery(b)
+func (s *server) handle(b []byte, remoteAddr net.Addr) {
+	bo := s.response(b, remoteAddr, "udp")
+	if bo == nil {
+		return
+	}
+	_, writeErr := s.conn.WriteTo(bo, remoteAddr)
+	if writeErr != nil {
+		log.Errorf("Error responding to DNS query: %v", writeErr)
+	}
+}
+
+// response processes the given query from the given client and returns the packed response, or nil if the query
+// should be dropped. Callers are expected to have checked the client's source network and rate limit with admit.
+func (s *server) response(b []byte, client net.Addr, protocol string) []byte {
+	ip := clientIP(client)
+	entry := s.newQueryLogEntry(client, protocol)
+	msgOut, err := s.processQuery(withClient(context.Background(), ip), b, entry)
+	if errors.Is(err, ErrInvalidQuery) {
+		log.Debugf("Dropping query from %v: %v", client, err)
+		return nil
+	}
 	if err != nil {
 		log.Error(err)
-		return
+		s.logQuery(entry, b, nil)
+		return nil
 	}
 
-	if numAnswers > 0 {
-		_, writeErr := s.conn.WriteToUDP(bo, remoteAddr)
-		if writeErr != nil {
-			log.Errorf("Error responding to DNS query: %v", writeErr)
-		}
+	// queries without answers are dropped, unless they failed in which case we let the client know
+	if len(msgOut.Answer) == 0 && msgOut.Rcode == dns.RcodeSuccess {
+		s.logQuery(entry, b, nil)
+		return nil
 	}
+	bo, err := msgOut.Pack()
+	if err != nil {
+		log.Error(err)
+		bo = nil
+	}
+	s.logQuery(entry, b, bo)
+	return bo
 }
 
-func (s *server) processAQuestion(question dns.Question) dns.RR {
-	fakeIP := s.getCachedFakeIP(question.Name)
-	if fakeIP == nil {
-		return nil
+func (s *server) processAQuestion(ctx context.Context, question dns.Question) (dns.RR, error) {
+	fakeIP, err := s.getCachedFakeIP(ctx, question.Name)
+	if fakeIP == nil || err != nil {
+		return nil, err
 	}
 	answer := &dns.A{}
 	// Short TTL should be fine since these DNS lookups are local and should be quite cheap
 	answer.Hdr = dns.RR_Header{Name: question.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 1}
 	answer.A = fakeIP
-	log.Debugf("resolved %v -> %v", question.Name, answer.A)
-	return answer
+	log.Debugf("resolved %v -> %v", s.loggableName(question.Name), answer.A)
+	return answer, nil
 }
 
-func (s *server) processAAAAQuestion(question dns.Question) dns.RR {
-	fakeIP := s.getCachedFakeIP(question.Name)
-	if fakeIP == nil {
-		return nil
+func (s *server) processAAAAQuestion(ctx context.Context, question dns.Question) (dns.RR, error) {
+	fakeIP, err := s.getCachedFakeIP(ctx, question.Name)
+	if fakeIP == nil || err != nil {
+		return nil, err
 	}
 	answer := &dns.AAAA{}
 	// Short TTL should be fine since these DNS lookups are local and should be quite cheap
@@ -229,74 +949,140 @@ func (s *server) processAAAAQuestion(question dns.Question) dns.RR {
 	fakeIPv6 := make(net.IP, net.IPv6len)
 	copy(fakeIPv6[12:], fakeIP)
 	answer.AAAA = fakeIPv6
-	log.Debugf("resolved %v -> %v", question.Name, answer.AAAA)
-	return answer
+	log.Debugf("resolved %v -> %v", s.loggableName(question.Name), answer.AAAA)
+	return answer, nil
 }
 
-func (s *server) getCachedFakeIP(name string) net.IP {
-	name = stripTrailingDot(name)
+func (s *server) getCachedFakeIP(ctx context.Context, name string) (net.IP, error) {
+	name = normalizeName(name)
 	if name == "" {
-		return nil
+		return nil, nil
 	}
-	s.mx.Lock()
-	ip, found := s.cache.IPByName(name)
-	if found {
-		s.cache.MarkFresh(name, ip)
+	if s.threadSafe {
+		s.mx.RLock()
+		defer s.mx.RUnlock()
+		nameLock := &s.nameLocks[hashName(name)%numNameLocks]
+		nameLock.Lock()
+		defer nameLock.Unlock()
 	} else {
-		// get next fake IP from sequence
-		ip = internal.IntToIP(s.cache.NextSequence())
-		s.cache.Add(name, ip)
+		s.mx.Lock()
+		defer s.mx.Unlock()
+	}
+	ip, found, err := s.cache.IPByName(name)
+	if err != nil {
+		return nil, err
+	}
+	s.cacheLookedUp(ctx, found)
+	if found {
+		if err := s.cache.MarkFresh(name, ip); err != nil {
+			return nil, err
+		}
+		s.subscribers.emit(EventRefreshed, name, ip)
+		return net.IP(ip), nil
+	}
+
+	if !s.limiter.allowAllocation(clientFromContext(ctx)) {
+		return nil, ErrAllocationLimited
+	}
+
+	// get next fake IP from sequence
+	next, err := s.cache.NextSequence()
+	if err != nil {
+		return nil, err
+	}
+	// the sequence only hands out internal.MinIP again after going through the whole range, so detecting the
+	// wrap-around here works even if allocations complete out of order
+	s.metrics.SequenceAdvanced(next, next == internal.MinIP && !s.unwrapped.CompareAndSwap(true, false))
+	ip = internal.IntToIP(next)
+	previousName, taken, err := s.cache.NameByIP(ip)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.cache.Add(name, ip); err != nil {
+		return nil, err
+	}
+	if taken {
+		// the sequence wrapped around onto an IP that was still in use
+		s.subscribers.emit(EventReassigned, previousName, ip)
 	}
-	s.mx.Unlock()
-	result := net.IP(ip)
-	return result
+	s.subscribers.emit(EventMapped, name, ip)
+	return net.IP(ip), nil
 }
 
-func (s *server) processQuestion(question dns.Question) dns.RR {
-	if question.Qclass != dns.ClassINET {
+// peekCachedFakeIP is like getCachedFakeIP but never allocates a new fake IP and doesn't mark existing mappings as
+// fresh.
+func (s *server) peekCachedFakeIP(name string) net.IP {
+	name = normalizeName(name)
+	if name == "" {
 		return nil
 	}
+	lookupLock := s.lookupLock()
+	lookupLock.Lock()
+	ip, found, err := s.cache.IPByName(name)
+	lookupLock.Unlock()
+	if err != nil {
+		log.Errorf("Unable to look up %v: %v", s.loggableName(name), err)
+		return nil
+	}
+	if !found {
+		return nil
+	}
+	return net.IP(ip)
+}
+
+func (s *server) processQuestion(ctx context.Context, question dns.Question) (dns.RR, error) {
+	if question.Qclass != dns.ClassINET {
+		return nil, nil
+	}
 	switch question.Qtype {
 	case dns.TypeA:
-		return s.processAQuestion(question)
+		return s.processAQuestion(ctx, question)
 	case dns.TypeAAAA:
-		return s.processAAAAQuestion(question)
+		return s.processAAAAQuestion(ctx, question)
 	case dns.TypePTR:
 		return s.processPTRQuestion(question)
 	default:
-		return nil
+		return nil, nil
 	}
 }
 
-func (s *server) processPTRQuestion(question dns.Question) dns.RR {
+func (s *server) processPTRQuestion(question dns.Question) (dns.RR, error) {
 	answer := &dns.PTR{}
 	// Short TTL should be fine since these DNS lookups are local and should be quite cheap
 	answer.Hdr = dns.RR_Header{Name: question.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 1}
 	parts := strings.Split(question.Name, ".")
 	if len(parts) < 4 {
-		return nil
+		return nil, nil
 	}
 	parts = parts[:4]
 	parts[0], parts[1], parts[2], parts[3] = parts[3], parts[2], parts[1], parts[0]
 	ipString := strings.Join(parts, ".")
 	ip := net.ParseIP(ipString).To4()
 	if len(ip) != 4 {
-		return nil
+		return nil, nil
 	}
-	s.mx.Lock()
-	name, found := s.cache.NameByIP(ip.To4())
-	s.mx.Unlock()
-	if !found {
-		return nil
+	lookupLock := s.lookupLock()
+	lookupLock.Lock()
+	name, found, err := s.cache.NameByIP(ip.To4())
+	lookupLock.Unlock()
+	if err != nil || !found {
+		return nil, err
 	}
-	log.Debugf("reversed %v -> %v", question.Name, name)
+	log.Debugf("reversed %v -> %v", question.Name, s.loggableName(name))
 	answer.Ptr = name + "."
-	return answer
+	return answer, nil
+}
+
+// normalizeName converts names as they appear in queries as well as names passed in directly by callers (which may
+// or may not be fully qualified) into the form in which they're stored in the cache. Since DNS names are case
+// insensitive, names are lowercased so that names differing only in case share the same fake IP.
+func normalizeName(name string) string {
+	return strings.ToLower(stripTrailingDot(name))
 }
 
 func stripTrailingDot(name string) string {
 	// strip trailing dot
-	if name[len(name)-1] == '.' {
+	if len(name) > 0 && name[len(name)-1] == '.' {
 		name = name[:len(name)-1]
 	}
 	return name
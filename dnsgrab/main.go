@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/binary"
 	"fmt"
 	"time"
 
@@ -22,14 +21,13 @@ func main() {
 func debugQueries(s dnsgrab.Server) {
 	for {
 		time.Sleep(1 * time.Second)
-		ip := make([]byte, 4)
-		for id := uint32(1); id < 100000; id++ {
-			binary.BigEndian.PutUint32(ip, id)
-			name, ok := s.ReverseLookup(ip)
-			if !ok {
-				break
-			}
-			fmt.Printf("%d -> %v\n", id, name)
+		entries, err := s.Snapshot()
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		for _, entry := range entries {
+			fmt.Printf("%v -> %v (fresh as of %v)\n", entry.IP, entry.Name, entry.Fresh.Format(time.RFC3339))
 		}
 	}
 }
@@ -1,11 +1,19 @@
 package dnsgrab
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"net"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
@@ -14,6 +22,10 @@ import (
 	"github.com/getlantern/dns"
 	"github.com/getlantern/dnsgrab/internal"
 	"github.com/getlantern/dnsgrab/persistentcache"
+	"github.com/getlantern/golog"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 const (
@@ -123,6 +135,1644 @@ func doTest(t *testing.T, cache Cache, startingIP uint32) {
 	}
 }
 
+func TestFakeIPFor(t *testing.T) {
+	s, err := ListenWithCache(":0", func() string { return "8.8.8.8" }, NewInMemoryCache(2))
+	require.NoError(t, err)
+	defer s.Close()
+	go s.Serve()
+
+	_, found := s.LookupName("domain1")
+	require.False(t, found, "peeking shouldn't find unmapped name")
+
+	ip := fakeIPFor(t, s, "domain1")
+	require.Equal(t, internal.IntToIP(internal.MinIP).String(), ip.String())
+	require.Equal(t, ip.String(), fakeIPFor(t, s, "domain1.").String(), "fully qualified name should map to same IP")
+
+	peeked, found := s.LookupName("domain1.")
+	require.True(t, found)
+	require.Equal(t, ip.String(), peeked.String())
+
+	q := &dns.Msg{}
+	q.SetQuestion("domain1.", dns.TypeA)
+	a, err := dns.Exchange(q, s.LocalAddr().String())
+	require.NoError(t, err)
+	require.Equal(t, ip.String(), a.Answer[0].(*dns.A).A.String(), "DNS query should return same IP as FakeIPFor")
+
+	require.Nil(t, fakeIPFor(t, s, ""))
+	_, found = s.LookupName("")
+	require.False(t, found)
+}
+
+func TestEvents(t *testing.T) {
+	cache := NewInMemoryCache(3)
+	s, err := ListenWithCache(":0", func() string { return "8.8.8.8" }, cache)
+	require.NoError(t, err)
+	defer s.Close()
+
+	var events []string
+	unsubscribe := s.Subscribe(func(e Event) {
+		events = append(events, e.String())
+	})
+
+	s.FakeIPFor("domain1")
+	// jump to the end of the sequence so that it wraps around onto domain1's IP
+	cache.(*inMemoryCache).sequence = internal.MaxIP
+	s.FakeIPFor("domain2")
+	s.FakeIPFor("domain2")
+	s.FakeIPFor("domain3")
+	s.FakeIPFor("domain4")
+	s.FakeIPFor("domain5")
+	unsubscribe()
+	s.FakeIPFor("domain6")
+
+	require.Equal(t, []string{
+		"mapped domain1 -> 240.0.0.1",
+		"mapped domain2 -> 255.255.255.254",
+		"refreshed domain2 -> 255.255.255.254",
+		"reassigned domain1 -> 240.0.0.1",
+		"mapped domain3 -> 240.0.0.1",
+		"mapped domain4 -> 240.0.0.2",
+		"evicted domain2 -> 255.255.255.254",
+		"mapped domain5 -> 240.0.0.3",
+	}, events)
+
+	_, found := s.LookupName("domain1")
+	require.False(t, found, "reassigned name should no longer be mapped")
+}
+
+func TestPersistentExpirationEvents(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "dnsgrab")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	cache, err := persistentcache.New(filepath.Join(tmpDir, "dnsgrab.db"), 250*time.Millisecond)
+	require.NoError(t, err)
+	defer cache.Close()
+
+	s, err := ListenWithCache(":0", func() string { return "8.8.8.8" }, cache)
+	require.NoError(t, err)
+	defer s.Close()
+
+	var events []string
+	s.Subscribe(func(e Event) {
+		events = append(events, e.String())
+	})
+
+	s.FakeIPFor("domain1")
+	time.Sleep(500 * time.Millisecond)
+	s.FakeIPFor("domain1")
+
+	require.Equal(t, []string{
+		"mapped domain1 -> 240.0.0.1",
+		"expired domain1 -> 240.0.0.1",
+		"mapped domain1 -> 240.0.0.2",
+	}, events)
+}
+
+func TestSnapshot(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "dnsgrab")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	persistent, err := persistentcache.New(filepath.Join(tmpDir, "dnsgrab.db"), maxAge)
+	require.NoError(t, err)
+	defer persistent.Close()
+
+	for _, cache := range []Cache{NewInMemoryCache(2), persistent} {
+		s, err := ListenWithCache(":0", func() string { return "8.8.8.8" }, cache)
+		require.NoError(t, err)
+
+		start := time.Now()
+		s.FakeIPFor("domain1")
+		s.FakeIPFor("domain2")
+		s.FakeIPFor("domain1")
+
+		entries, err := s.Snapshot()
+		require.NoError(t, err)
+		require.Len(t, entries, 2)
+		byName := make(map[string]Entry)
+		for _, entry := range entries {
+			byName[entry.Name] = entry
+			require.False(t, entry.Fresh.Before(start.Round(0)), "freshness should be recorded")
+		}
+		require.Equal(t, "240.0.0.1", byName["domain1"].IP.String())
+		require.Equal(t, "240.0.0.2", byName["domain2"].IP.String())
+		require.True(t, byName["domain1"].Fresh.After(byName["domain2"].Fresh), "refreshed entry should be fresher")
+		s.Close()
+	}
+}
+
+func TestRemoveAndFlush(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "dnsgrab")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	persistent, err := persistentcache.New(filepath.Join(tmpDir, "dnsgrab.db"), maxAge)
+	require.NoError(t, err)
+	defer persistent.Close()
+
+	for _, cache := range []Cache{NewInMemoryCache(10), persistent} {
+		s, err := ListenWithCache(":0", func() string { return "8.8.8.8" }, cache)
+		require.NoError(t, err)
+
+		var events []string
+		s.Subscribe(func(e Event) {
+			events = append(events, e.String())
+		})
+
+		ip1 := fakeIPFor(t, s, "domain1")
+		ip2 := fakeIPFor(t, s, "domain2")
+		s.FakeIPFor("domain3")
+
+		requireFound(t, true, s.Remove, "domain1.")
+		requireFound(t, false, s.Remove, "domain1")
+		_, found := s.ReverseLookup(ip1)
+		require.False(t, found, "removed name's IP should no longer reverse")
+
+		fakeIPv6 := make(net.IP, net.IPv6len)
+		copy(fakeIPv6[12:], ip2)
+		removed, err := s.RemoveIP(fakeIPv6)
+		require.NoError(t, err)
+		require.True(t, removed)
+		removed, err = s.RemoveIP(ip2)
+		require.NoError(t, err)
+		require.False(t, removed, "removing twice should fail")
+		_, found = s.LookupName("domain2")
+		require.False(t, found, "removed IP's name should no longer resolve")
+
+		require.NoError(t, s.Flush())
+		entries, err := s.Snapshot()
+		require.NoError(t, err)
+		require.Empty(t, entries)
+		require.Equal(t, "240.0.0.4", fakeIPFor(t, s, "domain1").String(), "flush shouldn't reset sequence")
+
+		require.Equal(t, []string{
+			"mapped domain1 -> 240.0.0.1",
+			"mapped domain2 -> 240.0.0.2",
+			"mapped domain3 -> 240.0.0.3",
+			"removed domain1 -> 240.0.0.1",
+			"removed domain2 -> 240.0.0.2",
+			"flushed",
+			"mapped domain1 -> 240.0.0.4",
+		}, events)
+		s.Close()
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "dnsgrab")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	for _, format := range []ExportFormat{FormatJSONLines, FormatBinary} {
+		src, err := ListenWithCache(":0", func() string { return "8.8.8.8" }, NewInMemoryCache(10))
+		require.NoError(t, err)
+		src.FakeIPFor("domain1")
+		src.FakeIPFor("domain2")
+		src.FakeIPFor("domain3")
+		requireFound(t, true, src.Remove, "domain2")
+		src.FakeIPFor("domain1")
+
+		var exported bytes.Buffer
+		require.NoError(t, src.Export(&exported, format))
+		src.Close()
+
+		persistent, err := persistentcache.New(filepath.Join(tmpDir, "dnsgrab.db"), maxAge)
+		require.NoError(t, err)
+		dst, err := ListenWithCache(":0", func() string { return "8.8.8.8" }, persistent)
+		require.NoError(t, err)
+		dst.FakeIPFor("other")
+
+		corrupted := bytes.Replace(exported.Bytes(), []byte("domain3"), []byte("domain1"), 1)
+		if format == FormatJSONLines {
+			corrupted = bytes.Replace(exported.Bytes(), []byte("240.0.0.3"), []byte("10.0.0.3"), 1)
+		}
+		require.ErrorIs(t, dst.Import(bytes.NewReader(corrupted), format), ErrInvalidExport)
+		_, found := dst.LookupName("other")
+		require.True(t, found, "failed import shouldn't modify cache")
+
+		require.NoError(t, dst.Import(bytes.NewReader(exported.Bytes()), format))
+		_, found = dst.LookupName("other")
+		require.False(t, found, "import should replace existing entries")
+		ip, _ := dst.LookupName("domain1")
+		require.Equal(t, "240.0.0.1", ip.String())
+		ip, _ = dst.LookupName("domain3")
+		require.Equal(t, "240.0.0.3", ip.String())
+		_, found = dst.LookupName("domain2")
+		require.False(t, found)
+		require.Equal(t, "240.0.0.4", fakeIPFor(t, dst, "domain4").String(), "import should restore sequence")
+
+		// round trip through the persistent cache into a fresh in-memory cache to make sure timestamps survive
+		var reexported bytes.Buffer
+		require.NoError(t, Export(persistent, &reexported, format))
+		roundTripped := NewInMemoryCache(10)
+		require.NoError(t, Import(roundTripped, &reexported, format))
+		var names []string
+		roundTripped.Range(func(name string, ip []byte, fresh time.Time) bool {
+			names = append(names, name)
+			return true
+		})
+		require.Equal(t, []string{"domain4", "domain1", "domain3"}, names, "entries should be ordered by freshness")
+
+		dst.Close()
+		persistent.Close()
+		os.Remove(filepath.Join(tmpDir, "dnsgrab.db"))
+	}
+}
+
+func TestImportValidation(t *testing.T) {
+	header := `{"format":"dnsgrab","version":1,"sequence":4026531841}` + "\n"
+	for input, condition := range map[string]string{
+		"": "missing header",
+		`{"format":"dnsgrab","version":2,"sequence":4026531841}`:                                                                                        "unsupported version",
+		`{"format":"dnsgrab","version":1,"sequence":1}`:                                                                                                 "sequence out of range",
+		header + `{"name":"domain1","ip":"10.0.0.1","fresh":"2024-01-01T00:00:00Z"}`:                                                                    "IP out of range",
+		header + `{"name":"domain1.","ip":"240.0.0.1","fresh":"2024-01-01T00:00:00Z"}`:                                                                  "trailing dot",
+		header + `{"name":"domain1","ip":"240.0.0.1"}`:                                                                                                  "missing timestamp",
+		header + `{"name":"domain1","ip":"240.0.0.1","fresh":"2024-01-01T00:00:00Z","extra":true}`:                                                      "unknown field",
+		header + `{"name":"a","ip":"240.0.0.1","fresh":"2024-01-01T00:00:00Z"}` + "\n" + `{"name":"a","ip":"240.0.0.2","fresh":"2024-01-01T00:00:00Z"}`: "duplicate name",
+		header + `{"name":"a","ip":"240.0.0.1","fresh":"2024-01-01T00:00:00Z"}` + "\n" + `{"name":"b","ip":"240.0.0.1","fresh":"2024-01-01T00:00:00Z"}`: "duplicate IP",
+	} {
+		err := Import(NewInMemoryCache(10), strings.NewReader(input), FormatJSONLines)
+		require.ErrorIs(t, err, ErrInvalidExport, condition)
+	}
+}
+
+func TestTieredCache(t *testing.T) {
+	for _, writeBehind := range []bool{false, true} {
+		writeBehind := writeBehind
+		name := "write-through"
+		if writeBehind {
+			name = "write-behind"
+		}
+		t.Run(name, func(t *testing.T) {
+			testTieredCache(t, writeBehind)
+		})
+	}
+}
+
+func testTieredCache(t *testing.T, writeBehind bool) {
+	tmpDir, err := ioutil.TempDir("", "dnsgrab")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	filename := filepath.Join(tmpDir, "dnsgrab.db")
+	back, err := persistentcache.New(filename, time.Minute)
+	require.NoError(t, err)
+	cache, err := NewTieredCache(2, back, writeBehind)
+	require.NoError(t, err)
+
+	s, err := ListenWithCache(":0", func() string { return "8.8.8.8" }, cache)
+	require.NoError(t, err)
+	defer s.Close()
+
+	ips := make(map[string]net.IP)
+	for _, name := range []string{"domain1", "domain2", "domain3", "domain4"} {
+		ips[name] = fakeIPFor(t, s, name)
+	}
+	require.Equal(t, 2, cache.front.mappings.Len(), "in-memory tier should be bounded")
+	for name, ip := range ips {
+		reversed, found := s.ReverseLookup(ip)
+		require.True(t, found, "lookups that miss the in-memory tier should be served from the backing cache")
+		require.Equal(t, name, reversed)
+	}
+
+	requireFound(t, true, s.Remove, "domain1")
+	_, found := s.LookupName("domain1")
+	require.False(t, found, "removed name shouldn't be found in either tier")
+	require.NoError(t, cache.Close())
+
+	back, err = persistentcache.New(filename, time.Minute)
+	require.NoError(t, err)
+	cache, err = NewTieredCache(2, back, writeBehind)
+	require.NoError(t, err)
+	defer cache.Close()
+	entries, err := entriesOf(cache)
+	require.NoError(t, err)
+	require.Len(t, entries, 3, "changes should be written to the backing cache")
+	require.Equal(t, 2, cache.front.mappings.Len(), "in-memory tier should be warmed from the backing cache")
+	for _, name := range []string{"domain1", "domain2"} {
+		_, found := cache.front.mappings.ByName(name)
+		require.False(t, found, "in-memory tier should be warmed with the freshest entries, not %v", name)
+	}
+}
+
+func TestTieredCacheExpiration(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "dnsgrab")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	back, err := persistentcache.NewWithOptions(filepath.Join(tmpDir, "dnsgrab.db"), &persistentcache.Options{
+		MaxAge:        250 * time.Millisecond,
+		SweepInterval: 10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	cache, err := NewTieredCache(10, back, true)
+	require.NoError(t, err)
+	defer cache.Close()
+
+	s, err := ListenWithCache(":0", func() string { return "8.8.8.8" }, cache)
+	require.NoError(t, err)
+	defer s.Close()
+
+	expired := make(chan Event, 1)
+	s.Subscribe(func(e Event) {
+		if e.Type == EventExpired {
+			expired <- e
+		}
+	})
+
+	ip := fakeIPFor(t, s, "domain1")
+	select {
+	case e := <-expired:
+		require.Equal(t, "domain1", e.Name)
+	case <-time.After(5 * time.Second):
+		t.Fatal("expiration in backing cache should be reported")
+	}
+	_, found := s.ReverseLookup(ip)
+	require.False(t, found, "entry expired in backing cache should be dropped from in-memory tier")
+}
+
+func TestTieredCacheLostEntries(t *testing.T) {
+	back := NewInMemoryCache(10)
+	cache, err := NewTieredCache(10, back, false)
+	require.NoError(t, err)
+	s, err := ListenWithCache(":0", func() string { return "8.8.8.8" }, cache)
+	require.NoError(t, err)
+	defer s.Close()
+
+	ip1 := fakeIPFor(t, s, "domain1")
+	// drop the entry from the backing cache without reporting it
+	_, _, err = back.Remove("domain1")
+	require.NoError(t, err)
+	require.Equal(t, ip1, fakeIPFor(t, s, "domain1"))
+	ip, found, err := back.IPByName("domain1")
+	require.NoError(t, err)
+	require.True(t, found, "entry lost by the backing cache should be added again when marked fresh")
+	require.Equal(t, ip1, net.IP(ip))
+
+	// reassign the IP in the backing cache without reporting it
+	_, _, err = back.Remove("domain1")
+	require.NoError(t, err)
+	require.NoError(t, back.Add("domain2", ip1))
+	fakeIPFor(t, s, "domain1")
+	name, found, err := back.NameByIP(ip1)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, "domain2", name, "reassigned IP shouldn't be taken back")
+	require.NotEqual(t, ip1, fakeIPFor(t, s, "domain1"), "stale entry should be dropped from the in-memory tier")
+	name, found = s.ReverseLookup(ip1)
+	require.True(t, found)
+	require.Equal(t, "domain2", name)
+}
+
+// unwritableCache is a Cache that fails to add entries
+type unwritableCache struct {
+	Cache
+}
+
+func (cache *unwritableCache) Restore(name string, ip []byte, fresh time.Time) error {
+	return errors.New("disk full")
+}
+
+func TestTieredCacheWriteBehindErrors(t *testing.T) {
+	cache, err := NewTieredCache(10, &unwritableCache{NewInMemoryCache(10)}, true)
+	require.NoError(t, err)
+	ip := internal.IntToIP(internal.MinIP)
+	require.NoError(t, cache.Add("domain1", ip), "error should only be known once written behind")
+	cache.mx.Lock()
+	cache.drain()
+	cache.mx.Unlock()
+	require.True(t, cache.Degraded(), "error from writing behind should degrade the cache")
+	require.NoError(t, cache.MarkFresh("domain1", ip), "error from writing behind shouldn't fail unrelated changes")
+	_, found, err := cache.IPByName("domain1")
+	require.NoError(t, err)
+	require.True(t, found, "changes should be kept in memory")
+
+	require.NoError(t, cache.Add("domain2", internal.IntToIP(internal.MinIP+1)))
+	require.Error(t, cache.Close(), "error from writing behind should be returned by Close")
+}
+
+// exclusiveCache is a Cache that fails the test if it's used concurrently
+type exclusiveCache struct {
+	Cache
+	t     *testing.T
+	inUse int32
+}
+
+func (cache *exclusiveCache) use() func() {
+	if !atomic.CompareAndSwapInt32(&cache.inUse, 0, 1) {
+		cache.t.Error("cache shouldn't be used concurrently")
+		return func() {}
+	}
+	return func() {
+		atomic.StoreInt32(&cache.inUse, 0)
+	}
+}
+
+func (cache *exclusiveCache) NameByIP(ip []byte) (string, bool, error) {
+	defer cache.use()()
+	time.Sleep(time.Millisecond)
+	return cache.Cache.NameByIP(ip)
+}
+
+func (cache *exclusiveCache) IPByName(name string) ([]byte, bool, error) {
+	defer cache.use()()
+	time.Sleep(time.Millisecond)
+	return cache.Cache.IPByName(name)
+}
+
+func TestLookupsWithoutThreadSafeCache(t *testing.T) {
+	s, err := ListenWithCache(":0", func() string { return "8.8.8.8" }, &exclusiveCache{Cache: NewInMemoryCache(10), t: t})
+	require.NoError(t, err)
+	defer s.Close()
+	ip, err := s.FakeIPFor("domain1")
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			s.ReverseLookup(ip)
+		}()
+		go func() {
+			defer wg.Done()
+			s.LookupName("domain1")
+		}()
+	}
+	wg.Wait()
+}
+
+func TestSharedCacheNotifications(t *testing.T) {
+	back := NewInMemoryCache(1)
+	var evicted []string
+	back.(EvictionNotifier).OnEvicted(func(name string, ip []byte) {
+		evicted = append(evicted, name)
+	})
+	cache, err := NewTieredCache(10, back, false)
+	require.NoError(t, err)
+	s, err := ListenWithCache(":0", func() string { return "8.8.8.8" }, cache)
+	require.NoError(t, err)
+	defer s.Close()
+	var events []Event
+	s.Subscribe(func(e Event) {
+		if e.Type == EventEvicted {
+			events = append(events, e)
+		}
+	})
+
+	fakeIPFor(t, s, "domain1")
+	fakeIPFor(t, s, "domain2")
+	require.Equal(t, []string{"domain1"}, evicted, "wrapping a cache shouldn't replace existing handlers")
+	require.Len(t, events, 1)
+	require.Equal(t, "domain1", events[0].Name)
+}
+
+func TestShardedCache(t *testing.T) {
+	cache := NewShardedCache(100, 8)
+	var evicted []string
+	cache.(EvictionNotifier).OnEvicted(func(name string, ip []byte) {
+		evicted = append(evicted, name)
+	})
+
+	// find two names that live in different shards
+	sharded := cache.(*shardedCache)
+	name1, name2 := "domain0", ""
+	for i := 1; name2 == ""; i++ {
+		candidate := fmt.Sprintf("domain%d", i)
+		if sharded.shardFor(candidate) != sharded.shardFor(name1) {
+			name2 = candidate
+		}
+	}
+	ip1 := internal.IntToIP(internal.MinIP)
+	ip2 := internal.IntToIP(internal.MinIP + 1)
+	require.NoError(t, cache.Add(name1, ip1))
+	require.NoError(t, cache.Add(name2, ip1))
+	name, found, err := cache.NameByIP(ip1)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, name2, name, "IP should be reassigned across shards")
+	_, found, err = cache.IPByName(name1)
+	require.NoError(t, err)
+	require.False(t, found, "previous mapping of reassigned IP should be dropped")
+	require.NoError(t, cache.Add(name2, ip2))
+	_, found, err = cache.NameByIP(ip1)
+	require.NoError(t, err)
+	require.False(t, found, "previous IP of remapped name should be dropped")
+
+	// lookups shouldn't need to lock anything
+	shard := sharded.shardFor(name2)
+	shard.mx.Lock()
+	ip, found, err := cache.IPByName(name2)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, ip2, net.IP(ip))
+	name, found, err = cache.NameByIP(ip2)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, name2, name)
+	shard.mx.Unlock()
+
+	for i := 0; i < 1000; i++ {
+		require.NoError(t, cache.Add(fmt.Sprintf("filler%d", i), internal.IntToIP(internal.MinIP+2+uint32(i))))
+	}
+	entries, err := entriesOf(cache)
+	require.NoError(t, err)
+	require.True(t, len(entries) <= 104, "cache should stay within its size, give or take rounding per shard")
+	require.Equal(t, 1001-len(entries), len(evicted))
+	for i := 1; i < len(entries); i++ {
+		require.False(t, entries[i].Fresh.After(entries[i-1].Fresh), "entries should be ranged from most to least recently used")
+	}
+}
+
+func TestConcurrentQueries(t *testing.T) {
+	s, err := ListenWithCache(":0", func() string { return "8.8.8.8" }, NewShardedCache(10000, 16))
+	require.NoError(t, err)
+	defer s.Close()
+
+	const numNames = 100
+	var wg sync.WaitGroup
+	var mx sync.Mutex
+	ipsByName := make(map[string]map[string]bool)
+	for g := 0; g < 16; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < numNames; i++ {
+				name := fmt.Sprintf("domain%d", (i+g)%numNames)
+				ip, err := s.FakeIPFor(name)
+				require.NoError(t, err)
+				reversed, found := s.ReverseLookup(ip)
+				require.True(t, found)
+				require.Equal(t, name, reversed)
+				mx.Lock()
+				if ipsByName[name] == nil {
+					ipsByName[name] = make(map[string]bool)
+				}
+				ipsByName[name][ip.String()] = true
+				mx.Unlock()
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	require.Len(t, ipsByName, numNames)
+	for name, ips := range ipsByName {
+		require.Len(t, ips, 1, "concurrent queries for %v should all get the same fake IP", name)
+	}
+}
+
+func TestServeConcurrentQueries(t *testing.T) {
+	s, err := ListenWithOptions(":0", func() string { return "8.8.8.8" }, NewShardedCache(10000, 16), &Options{Concurrency: 4})
+	require.NoError(t, err)
+	defer s.Close()
+	go s.Serve()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			q := &dns.Msg{}
+			q.SetQuestion(fmt.Sprintf("domain%d.", i), dns.TypeA)
+			a, err := dns.Exchange(q, s.LocalAddr().String())
+			require.NoError(t, err)
+			require.Len(t, a.Answer, 1)
+			require.Equal(t, q.Question[0].Name, a.Answer[0].Header().Name, "answer should be for the question that was asked")
+		}(i)
+	}
+	wg.Wait()
+}
+
+// blockingCache blocks lookups by name until released
+type blockingCache struct {
+	Cache
+	blocked  chan interface{}
+	released chan interface{}
+}
+
+func (cache *blockingCache) IPByName(name string) ([]byte, bool, error) {
+	cache.blocked <- nil
+	<-cache.released
+	return cache.Cache.IPByName(name)
+}
+
+func TestLoadShedding(t *testing.T) {
+	cache := &blockingCache{
+		Cache:    NewInMemoryCache(10),
+		blocked:  make(chan interface{}, 10),
+		released: make(chan interface{}),
+	}
+	s, err := ListenWithOptions(":0", func() string { return "8.8.8.8" }, cache, &Options{Concurrency: 1, QueueDepth: 1})
+	require.NoError(t, err)
+	defer s.Close()
+	go s.Serve()
+
+	exchange := func(name string) chan *dns.Msg {
+		result := make(chan *dns.Msg, 1)
+		go func() {
+			q := &dns.Msg{}
+			q.SetQuestion(name, dns.TypeA)
+			a, err := dns.Exchange(q, s.LocalAddr().String())
+			require.NoError(t, err)
+			result <- a
+		}()
+		return result
+	}
+
+	// occupy the only worker
+	first := exchange("domain1.")
+	<-cache.blocked
+	// fill the queue
+	second := exchange("domain2.")
+	time.Sleep(250 * time.Millisecond)
+	refused := <-exchange("domain3.")
+	require.Equal(t, dns.RcodeRefused, refused.Rcode, "queries beyond the queue depth should be refused")
+
+	close(cache.released)
+	require.Len(t, (<-first).Answer, 1)
+	require.Len(t, (<-second).Answer, 1)
+}
+
+// closeableCache records whether it was closed
+type closeableCache struct {
+	*blockingCache
+	closed chan interface{}
+}
+
+func (cache *closeableCache) Close() error {
+	close(cache.closed)
+	return nil
+}
+
+func TestShutdown(t *testing.T) {
+	cache := &closeableCache{
+		blockingCache: &blockingCache{
+			Cache:    NewInMemoryCache(10),
+			blocked:  make(chan interface{}, 10),
+			released: make(chan interface{}),
+		},
+		closed: make(chan interface{}),
+	}
+	s, err := ListenWithCache(":0", func() string { return "8.8.8.8" }, cache)
+	require.NoError(t, err)
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve()
+	}()
+
+	answered := make(chan *dns.Msg, 1)
+	go func() {
+		q := &dns.Msg{}
+		q.SetQuestion("domain1.", dns.TypeA)
+		a, err := dns.Exchange(q, s.LocalAddr().String())
+		require.NoError(t, err)
+		answered <- a
+	}()
+	<-cache.blocked
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- s.Shutdown(context.Background())
+	}()
+	select {
+	case <-shutdown:
+		t.Fatal("shutdown shouldn't finish while queries are in flight")
+	case <-time.After(250 * time.Millisecond):
+	}
+
+	close(cache.released)
+	require.Len(t, (<-answered).Answer, 1, "in-flight query should be answered")
+	require.NoError(t, <-shutdown)
+	require.Equal(t, ErrServerClosed, <-served)
+	select {
+	case <-cache.closed:
+	default:
+		t.Fatal("cache should be closed")
+	}
+	require.NoError(t, s.Shutdown(context.Background()), "shutting down twice should be fine")
+	require.Equal(t, ErrServerClosed, s.Serve(), "serving after shutdown should fail")
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	cache := &blockingCache{
+		Cache:    NewInMemoryCache(10),
+		blocked:  make(chan interface{}, 10),
+		released: make(chan interface{}),
+	}
+	defer close(cache.released)
+	s, err := ListenWithCache(":0", func() string { return "8.8.8.8" }, cache)
+	require.NoError(t, err)
+	go s.Serve()
+
+	go func() {
+		q := &dns.Msg{}
+		q.SetQuestion("domain1.", dns.TypeA)
+		dns.Exchange(q, s.LocalAddr().String())
+	}()
+	<-cache.blocked
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, s.Shutdown(ctx))
+}
+
+func TestCloseStopsServe(t *testing.T) {
+	s, err := ListenWithCache(":0", func() string { return "8.8.8.8" }, NewInMemoryCache(10))
+	require.NoError(t, err)
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve()
+	}()
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, s.Close())
+	select {
+	case err := <-served:
+		require.Equal(t, ErrServerClosed, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve should return after Close")
+	}
+}
+
+func TestPacketConn(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := NewWithPacketConn(conn, func() string { return "8.8.8.8" }, NewInMemoryCache(10), &Options{})
+	require.Equal(t, conn.LocalAddr(), s.LocalAddr())
+	go s.Serve()
+	defer s.Close()
+
+	q := &dns.Msg{}
+	q.SetQuestion("domain1.", dns.TypeA)
+	a, err := dns.Exchange(q, s.LocalAddr().String())
+	require.NoError(t, err)
+	require.Len(t, a.Answer, 1)
+	require.Equal(t, "240.0.0.1", a.Answer[0].(*dns.A).A.String())
+}
+
+func TestPacketConnClosedByOwner(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := NewWithPacketConn(conn, func() string { return "8.8.8.8" }, NewInMemoryCache(10), &Options{})
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve()
+	}()
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, conn.Close())
+	select {
+	case err := <-served:
+		require.ErrorIs(t, err, net.ErrClosed)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve should return once its conn is closed")
+	}
+}
+
+// noDeadlineConn is a PacketConn that doesn't support deadlines
+type noDeadlineConn struct {
+	net.PacketConn
+}
+
+func (conn *noDeadlineConn) SetReadDeadline(t time.Time) error {
+	return errors.New("deadlines not supported")
+}
+
+func TestShutdownWithoutDeadlines(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := NewWithPacketConn(&noDeadlineConn{conn}, func() string { return "8.8.8.8" }, NewInMemoryCache(10), &Options{})
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve()
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, s.Shutdown(ctx), "shutdown should close conns without deadlines instead of waiting")
+	require.Equal(t, ErrServerClosed, <-served)
+}
+
+func TestNamesAreCaseInsensitive(t *testing.T) {
+	s, err := ListenWithCache(":0", func() string { return "8.8.8.8" }, NewInMemoryCache(10))
+	require.NoError(t, err)
+	defer s.Close()
+
+	ip := fakeIPFor(t, s, "Domain1.Example.com.")
+	require.Equal(t, ip, fakeIPFor(t, s, "domain1.example.com"), "names differing only in case should share a fake IP")
+	name, found := s.ReverseLookup(ip)
+	require.True(t, found)
+	require.Equal(t, "domain1.example.com", name)
+	looked, found := s.LookupName("DOMAIN1.EXAMPLE.COM")
+	require.True(t, found)
+	require.Equal(t, ip, looked)
+}
+
+func TestNilOptions(t *testing.T) {
+	s, err := ListenWithOptions(":0", func() string { return "8.8.8.8" }, NewInMemoryCache(10), nil)
+	require.NoError(t, err, "nil options should be the same as empty ones")
+	require.NoError(t, s.Close())
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s = NewWithListener(l, func() string { return "8.8.8.8" }, NewInMemoryCache(10), nil)
+	require.NoError(t, s.Close())
+}
+
+func TestListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := NewWithListener(l, func() string { return "8.8.8.8" }, NewInMemoryCache(10), &Options{})
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve()
+	}()
+
+	conn, err := dns.Dial("tcp", s.LocalAddr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	for i, name := range []string{"domain1.", "domain2."} {
+		q := &dns.Msg{}
+		q.SetQuestion(name, dns.TypeA)
+		require.NoError(t, conn.WriteMsg(q))
+		a, err := conn.ReadMsg()
+		require.NoError(t, err)
+		require.Len(t, a.Answer, 1, "connection should be reused for multiple queries")
+		require.Equal(t, internal.IntToIP(internal.MinIP+uint32(i)).String(), a.Answer[0].(*dns.A).A.String())
+	}
+
+	require.NoError(t, s.Shutdown(context.Background()))
+	require.Equal(t, ErrServerClosed, <-served)
+}
+
+// flakyListener is a listener that fails to accept connections a number of times first
+type flakyListener struct {
+	net.Listener
+	failures int32
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if atomic.AddInt32(&l.failures, -1) >= 0 {
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Err: syscall.EMFILE}
+	}
+	return l.Listener.Accept()
+}
+
+func TestListenerLimits(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := NewWithListener(&flakyListener{Listener: l, failures: 3}, func() string { return "8.8.8.8" }, NewInMemoryCache(10), &Options{Concurrency: 1})
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve()
+	}()
+
+	query := func(conn *dns.Conn, name string) error {
+		q := &dns.Msg{}
+		q.SetQuestion(name, dns.TypeA)
+		if err := conn.WriteMsg(q); err != nil {
+			return err
+		}
+		conn.SetReadDeadline(time.Now().Add(250 * time.Millisecond))
+		_, err := conn.ReadMsg()
+		return err
+	}
+	first, err := dns.Dial("tcp", s.LocalAddr().String())
+	require.NoError(t, err)
+	require.NoError(t, query(first, "domain1."), "running out of file descriptors shouldn't stop serving")
+
+	second, err := dns.Dial("tcp", s.LocalAddr().String())
+	require.NoError(t, err)
+	defer second.Close()
+	require.Error(t, query(second, "domain2."), "connections beyond Concurrency shouldn't be handled")
+	first.Close()
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = second.ReadMsg()
+	require.NoError(t, err, "waiting connection should be handled once another one is closed")
+
+	require.NoError(t, s.Shutdown(context.Background()))
+	require.Equal(t, ErrServerClosed, <-served)
+}
+
+func TestProcessPacket(t *testing.T) {
+	s, err := ListenWithCache(":0", func() string { return "8.8.8.8" }, NewInMemoryCache(10))
+	require.NoError(t, err)
+	defer s.Close()
+
+	q := &dns.Msg{}
+	q.SetQuestion("domain1.", dns.TypeA)
+	query, err := q.Pack()
+	require.NoError(t, err)
+	client, resolver := net.ParseIP("10.0.0.2"), net.ParseIP("10.0.0.1")
+	client6, resolver6 := net.ParseIP("fd00::2"), net.ParseIP("fd00::1")
+
+	udp := make([]byte, udpHeaderLen+len(query))
+	binary.BigEndian.PutUint16(udp, 12345)
+	binary.BigEndian.PutUint16(udp[2:], 53)
+	binary.BigEndian.PutUint16(udp[4:], uint16(len(udp)))
+	copy(udp[udpHeaderLen:], query)
+
+	ipv4 := make([]byte, ipv4HeaderLen, ipv4HeaderLen+len(udp))
+	ipv4[0] = 0x45
+	binary.BigEndian.PutUint16(ipv4[2:], uint16(ipv4HeaderLen+len(udp)))
+	ipv4[8] = 64
+	ipv4[9] = protocolUDP
+	copy(ipv4[12:], client.To4())
+	copy(ipv4[16:], resolver.To4())
+	ipv4 = append(ipv4, udp...)
+
+	ipv6 := make([]byte, ipv6HeaderLen, ipv6HeaderLen+len(udp))
+	ipv6[0] = 0x60
+	binary.BigEndian.PutUint16(ipv6[4:], uint16(len(udp)))
+	ipv6[6] = protocolUDP
+	ipv6[7] = 64
+	copy(ipv6[8:], client6)
+	copy(ipv6[24:], resolver6)
+	ipv6 = append(ipv6, udp...)
+
+	checkUDP := func(datagram []byte, src, dst net.IP) {
+		require.Equal(t, uint16(53), binary.BigEndian.Uint16(datagram))
+		require.Equal(t, uint16(12345), binary.BigEndian.Uint16(datagram[2:]))
+		require.Equal(t, len(datagram), int(binary.BigEndian.Uint16(datagram[4:])))
+		require.Equal(t, uint16(0xffff), checksum(pseudoHeaderSum(src, dst, len(datagram)), datagram), "UDP checksum should be valid")
+		a := &dns.Msg{}
+		require.NoError(t, a.Unpack(datagram[udpHeaderLen:]))
+		require.Equal(t, q.Id, a.Id)
+		require.Len(t, a.Answer, 1)
+		require.Equal(t, "240.0.0.1", a.Answer[0].(*dns.A).A.String())
+	}
+
+	response, err := s.ProcessPacket(ipv4)
+	require.NoError(t, err)
+	require.Equal(t, byte(0x45), response[0])
+	require.Equal(t, len(response), int(binary.BigEndian.Uint16(response[2:])))
+	require.Equal(t, uint16(0xffff), checksum(0, response[:ipv4HeaderLen]), "IPv4 header checksum should be valid")
+	require.Equal(t, resolver.To4(), net.IP(response[12:16]), "addresses should be swapped")
+	require.Equal(t, client.To4(), net.IP(response[16:20]), "addresses should be swapped")
+	checkUDP(response[ipv4HeaderLen:], resolver.To4(), client.To4())
+
+	response, err = s.ProcessPacket(ipv6)
+	require.NoError(t, err)
+	require.Equal(t, byte(0x60), response[0])
+	require.Equal(t, len(response)-ipv6HeaderLen, int(binary.BigEndian.Uint16(response[4:])))
+	require.Equal(t, resolver6, net.IP(response[8:24]), "addresses should be swapped")
+	require.Equal(t, client6, net.IP(response[24:40]), "addresses should be swapped")
+	checkUDP(response[ipv6HeaderLen:], resolver6, client6)
+
+	fragmented := append([]byte{}, ipv4...)
+	fragmented[6] = 0x20
+	for _, packet := range [][]byte{nil, ipv4[:10], ipv6[:30], ipv4[:ipv4HeaderLen+4], fragmented} {
+		_, err := s.ProcessPacket(packet)
+		require.ErrorIs(t, err, ErrInvalidPacket)
+	}
+}
+
+type failingCache struct {
+	Cache
+}
+
+func (cache *failingCache) IPByName(name string) ([]byte, bool, error) {
+	return nil, false, errors.New("disk full")
+}
+
+func TestCacheFailure(t *testing.T) {
+	s, err := ListenWithCache(":0", func() string { return "8.8.8.8" }, &failingCache{NewInMemoryCache(2)})
+	require.NoError(t, err)
+	defer s.Close()
+	go s.Serve()
+
+	q := &dns.Msg{}
+	q.SetQuestion("domain1.", dns.TypeA)
+	a, err := dns.Exchange(q, s.LocalAddr().String())
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeServerFailure, a.Rcode)
+	require.Empty(t, a.Answer)
+
+	_, err = s.FakeIPFor("domain1")
+	require.Error(t, err)
+}
+
+type recordingMetrics struct {
+	questions map[string]int
+	hits      int
+	misses    int
+	events    map[EventType]int
+	size      int
+	sequence  uint32
+	wraps     int
+	mx        sync.Mutex
+}
+
+func (m *recordingMetrics) QuestionHandled(qtype string, outcome Outcome) {
+	m.mx.Lock()
+	m.questions[qtype+" "+outcome.String()]++
+	m.mx.Unlock()
+}
+
+func (m *recordingMetrics) UpstreamExchanged(server string, latency time.Duration, err error) {}
+
+func (m *recordingMetrics) CacheLookedUp(hit bool) {
+	m.mx.Lock()
+	if hit {
+		m.hits++
+	} else {
+		m.misses++
+	}
+	m.mx.Unlock()
+}
+
+func (m *recordingMetrics) CacheChanged(event EventType, size int) {
+	m.mx.Lock()
+	m.events[event]++
+	m.size = size
+	m.mx.Unlock()
+}
+
+func (m *recordingMetrics) SequenceAdvanced(next uint32, wrapped bool) {
+	m.mx.Lock()
+	m.sequence = next
+	if wrapped {
+		m.wraps++
+	}
+	m.mx.Unlock()
+}
+
+func TestMetrics(t *testing.T) {
+	cache := NewInMemoryCache(2)
+	require.NoError(t, cache.Add("existing", internal.IntToIP(internal.MinIP+5)))
+	require.NoError(t, cache.SetSequence(internal.MaxIP))
+	m := &recordingMetrics{questions: make(map[string]int), events: make(map[EventType]int)}
+	s, err := ListenWithOptions(":0", func() string { return "8.8.8.8" }, cache, &Options{Metrics: m})
+	require.NoError(t, err)
+	defer s.Close()
+
+	query := func(name string, qtype uint16) {
+		q := &dns.Msg{}
+		q.SetQuestion(name, qtype)
+		b, err := q.Pack()
+		require.NoError(t, err)
+		_, _, err = s.ProcessQuery(b)
+		require.NoError(t, err)
+	}
+	query("domain1.", dns.TypeA)
+	query("domain2.", dns.TypeAAAA)
+	query("domain1.", dns.TypeA)
+	query("domain1.", dns.TypeHTTPS)
+
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	require.Equal(t, map[string]int{"A grabbed": 2, "AAAA grabbed": 1, "HTTPS dropped": 1}, m.questions)
+	require.Equal(t, 1, m.hits)
+	require.Equal(t, 2, m.misses)
+	require.Equal(t, 2, m.events[EventMapped])
+	require.Equal(t, 1, m.events[EventEvicted], "existing should have been evicted")
+	require.Equal(t, 2, m.size)
+	require.Equal(t, internal.MinIP, m.sequence)
+	require.Equal(t, 1, m.wraps)
+
+	require.Equal(t, "AAAA", qtypeLabel(dns.TypeAAAA))
+	require.Equal(t, "other", qtypeLabel(65000), "unknown types shouldn't get their own label")
+}
+
+func TestMetricsConcurrentWraps(t *testing.T) {
+	m := &recordingMetrics{questions: make(map[string]int), events: make(map[EventType]int)}
+	s, err := ListenWithOptions(":0", func() string { return "8.8.8.8" }, NewShardedCache(100, 8), &Options{Metrics: m})
+	require.NoError(t, err)
+	defer s.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				_, err := s.FakeIPFor(fmt.Sprintf("domain%d-%d", i, j))
+				require.NoError(t, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	m.mx.Lock()
+	require.Zero(t, m.wraps, "concurrent allocations shouldn't be mistaken for wrap-arounds")
+	m.mx.Unlock()
+
+	require.NoError(t, s.(*server).cache.SetSequence(internal.MaxIP))
+	_, err = s.FakeIPFor("last")
+	require.NoError(t, err)
+	_, err = s.FakeIPFor("first")
+	require.NoError(t, err)
+	m.mx.Lock()
+	require.Equal(t, 1, m.wraps)
+	m.mx.Unlock()
+}
+
+func TestMetricsImport(t *testing.T) {
+	src, err := ListenWithCache(":0", func() string { return "8.8.8.8" }, NewInMemoryCache(10))
+	require.NoError(t, err)
+	defer src.Close()
+	for i := 0; i < 5; i++ {
+		fakeIPFor(t, src, fmt.Sprintf("domain%d", i))
+	}
+	var exported bytes.Buffer
+	require.NoError(t, src.Export(&exported, FormatBinary))
+
+	m := &recordingMetrics{questions: make(map[string]int), events: make(map[EventType]int)}
+	s, err := ListenWithOptions(":0", func() string { return "8.8.8.8" }, NewInMemoryCache(2), &Options{Metrics: m})
+	require.NoError(t, err)
+	defer s.Close()
+	var mapped []string
+	s.Subscribe(func(e Event) {
+		if e.Type == EventMapped {
+			mapped = append(mapped, e.Name)
+		}
+	})
+	require.NoError(t, s.Import(&exported, FormatBinary))
+
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	require.Equal(t, 2, m.size, "size should match what the cache kept when importing more entries than fit")
+	require.Equal(t, []string{"domain3", "domain4"}, mapped, "only entries kept by the cache should be reported")
+}
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	s, err := ListenWithOptions(":0", func() string { return "8.8.8.8" }, NewInMemoryCache(10), &Options{TracerProvider: tp})
+	require.NoError(t, err)
+	defer s.Close()
+
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "dial")
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeA, dns.TypeHTTPS} {
+		q := &dns.Msg{}
+		q.SetQuestion("domain1.", qtype)
+		b, err := q.Pack()
+		require.NoError(t, err)
+		_, _, err = s.ProcessQueryContext(ctx, b)
+		require.NoError(t, err)
+	}
+	parent.End()
+
+	var queries int
+	var questions []map[attribute.Key]string
+	for _, span := range recorder.Ended() {
+		switch span.Name() {
+		case "dnsgrab.ProcessQuery":
+			queries++
+			require.Equal(t, parent.SpanContext().SpanID(), span.Parent().SpanID())
+		case "dnsgrab.question":
+			attrs := make(map[attribute.Key]string)
+			for _, attr := range span.Attributes() {
+				attrs[attr.Key] = attr.Value.Emit()
+			}
+			questions = append(questions, attrs)
+		}
+	}
+	require.Equal(t, 3, queries)
+	require.Equal(t, []map[attribute.Key]string{
+		{attrQuestionName: "domain1.", attrQuestionType: "A", attrCacheResult: "miss", attrOutcome: "grabbed"},
+		{attrQuestionName: "domain1.", attrQuestionType: "A", attrCacheResult: "hit", attrOutcome: "grabbed"},
+		{attrQuestionName: "domain1.", attrQuestionType: "HTTPS", attrOutcome: "dropped"},
+	}, questions)
+}
+
+type recordingQueryLog struct {
+	entries []*QueryLogEntry
+	mx      sync.Mutex
+}
+
+func (l *recordingQueryLog) LogQuery(entry *QueryLogEntry) {
+	l.mx.Lock()
+	l.entries = append(l.entries, entry)
+	l.mx.Unlock()
+}
+
+func TestQueryLog(t *testing.T) {
+	query := func(opts *Options, name string, qtype uint16) {
+		s, err := ListenWithOptions(":0", func() string { return "8.8.8.8" }, NewInMemoryCache(10), opts)
+		require.NoError(t, err)
+		defer s.Close()
+		q := &dns.Msg{}
+		q.SetQuestion(name, qtype)
+		_, err = s.ProcessPacket(makeUDPPacket(t, net.IPv4(10, 0, 0, 2), q))
+		require.NoError(t, err)
+	}
+
+	ql := &recordingQueryLog{}
+	query(&Options{QueryLog: ql}, "domain1.", dns.TypeA)
+	query(&Options{QueryLog: ql}, "domain1.", dns.TypeHTTPS)
+	require.Len(t, ql.entries, 2)
+	entry := ql.entries[0]
+	require.Equal(t, "10.0.0.2:5353", entry.Client.String())
+	require.Equal(t, "udp", entry.Protocol)
+	require.Equal(t, dns.RcodeSuccess, entry.Rcode)
+	require.NotEmpty(t, entry.Query)
+	require.NotEmpty(t, entry.Response)
+	require.Equal(t, []QuestionLogEntry{{Name: "domain1.", Type: "A", Outcome: OutcomeGrabbed, FakeIP: internal.IntToIP(internal.MinIP)}}, entry.Questions)
+	entry = ql.entries[1]
+	require.Nil(t, entry.Response, "dropped query shouldn't have a response")
+	require.Equal(t, []QuestionLogEntry{{Name: "domain1.", Type: "HTTPS", Outcome: OutcomeDropped}}, entry.Questions)
+
+	ql = &recordingQueryLog{}
+	query(&Options{QueryLog: ql, QueryLogRedaction: RedactClient | RedactNames}, "domain1.", dns.TypeA)
+	require.Len(t, ql.entries, 1)
+	entry = ql.entries[0]
+	require.Nil(t, entry.Client)
+	require.Nil(t, entry.Query)
+	require.Nil(t, entry.Response)
+	require.Empty(t, entry.Questions[0].Name)
+	require.Equal(t, OutcomeGrabbed, entry.Questions[0].Outcome)
+
+	ql = &recordingQueryLog{}
+	for i := 0; i < 10; i++ {
+		query(&Options{QueryLog: ql, QueryLogSampleRate: 1e-12}, "domain1.", dns.TypeA)
+	}
+	require.Empty(t, ql.entries, "queries should have been sampled out")
+}
+
+type syncBuffer struct {
+	buf bytes.Buffer
+	mx  sync.Mutex
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return b.buf.String()
+}
+
+func TestPrivacyMode(t *testing.T) {
+	var out syncBuffer
+	reset := golog.SetOutputs(&out, &out)
+	defer reset()
+
+	ql := &recordingQueryLog{}
+	opts := &Options{QueryLog: ql, PrivacyKey: []byte("secret key")}
+	query := func(cache Cache, name string) {
+		s, err := ListenWithOptions(":0", func() string { return "8.8.8.8" }, cache, opts)
+		require.NoError(t, err)
+		defer s.Close()
+		q := &dns.Msg{}
+		q.SetQuestion(name, dns.TypeA)
+		b, err := q.Pack()
+		require.NoError(t, err)
+		_, _, err = s.ProcessQuery(b)
+		require.NoError(t, err)
+	}
+	query(NewInMemoryCache(10), "secret.example.com.")
+	query(&failingCache{NewInMemoryCache(10)}, "SECRET.example.com.")
+
+	require.NotContains(t, strings.ToLower(out.String()), "secret.example.com", "name shouldn't appear in log output")
+	require.Contains(t, out.String(), "name-", "hashed name should appear in log output instead")
+	require.Len(t, ql.entries, 2)
+	hashed := ql.entries[0].Questions[0].Name
+	require.True(t, strings.HasPrefix(hashed, "name-"), hashed)
+	require.Equal(t, hashed, ql.entries[1].Questions[0].Name, "hashes of the same name should match")
+	require.Nil(t, ql.entries[0].Query)
+	require.Nil(t, ql.entries[0].Response)
+}
+
+func TestRateLimit(t *testing.T) {
+	s, err := ListenWithOptions(":0", func() string { return "8.8.8.8" }, NewInMemoryCache(10), &Options{RateLimit: 0.001, RateBurst: 2})
+	require.NoError(t, err)
+	defer s.Close()
+
+	client, other := net.IPv4(10, 0, 0, 2), net.IPv4(10, 0, 0, 3)
+	require.NotNil(t, queryFrom(t, s, client, "domain1."))
+	require.NotNil(t, queryFrom(t, s, client, "domain1."))
+	require.Nil(t, queryFrom(t, s, client, "domain1."), "query beyond burst should be dropped")
+	require.NotNil(t, queryFrom(t, s, other, "domain1."), "other clients shouldn't be limited")
+
+	q := &dns.Msg{}
+	q.SetQuestion("domain1.", dns.TypeA)
+	b, err := q.Pack()
+	require.NoError(t, err)
+	admitted, refusal := s.(*server).admit(b, &net.UDPAddr{IP: client, Port: 5353})
+	require.False(t, admitted, "queries beyond the rate limit should be dropped before they're queued")
+	require.Nil(t, refusal)
+}
+
+func TestClientLimiterBounds(t *testing.T) {
+	l := newClientLimiter(&Options{RateLimit: 0.001, RateBurst: 1})
+	require.True(t, l.allowQuery(net.ParseIP("2001:db8::1")))
+	require.False(t, l.allowQuery(net.ParseIP("2001:db8::2")), "IPv6 clients in the same /64 should share their limit")
+	require.True(t, l.allowQuery(net.ParseIP("2001:db8:0:1::1")), "IPv6 clients in other networks shouldn't be limited")
+
+	clientIP := func(i int) net.IP {
+		return net.IPv4(10, byte(i>>16), byte(i>>8), byte(i))
+	}
+	for i := 0; i < maxTrackedClients+10; i++ {
+		l.allowQuery(clientIP(i))
+	}
+	require.Len(t, l.clients, maxTrackedClients, "number of tracked clients should be bounded")
+	require.Equal(t, maxTrackedClients, l.ll.Len())
+	require.False(t, l.allowQuery(clientIP(maxTrackedClients+9)), "recently seen clients should still be limited")
+	require.True(t, l.allowQuery(clientIP(0)), "least recently seen clients should have been forgotten")
+}
+
+func TestAllocationLimit(t *testing.T) {
+	s, err := ListenWithOptions(":0", func() string { return "8.8.8.8" }, NewInMemoryCache(10), &Options{AllocationLimit: 2})
+	require.NoError(t, err)
+	defer s.Close()
+
+	client, other := net.IPv4(10, 0, 0, 2), net.IPv4(10, 0, 0, 3)
+	require.Len(t, queryFrom(t, s, client, "domain1.").Answer, 1)
+	require.Len(t, queryFrom(t, s, client, "domain2.").Answer, 1)
+	resp := queryFrom(t, s, client, "domain3.")
+	require.Equal(t, dns.RcodeRefused, resp.Rcode, "allocation beyond limit should be refused")
+	require.Empty(t, resp.Answer)
+	require.Len(t, queryFrom(t, s, client, "domain1.").Answer, 1, "existing mappings should still be answered")
+	require.Len(t, queryFrom(t, s, other, "domain3.").Answer, 1, "other clients shouldn't be limited")
+	_, err = s.FakeIPFor("domain4")
+	require.NoError(t, err, "allocations without a client shouldn't be limited")
+}
+
+func TestAllowedNetworks(t *testing.T) {
+	_, network, err := net.ParseCIDR("10.0.0.0/24")
+	require.NoError(t, err)
+	s, err := ListenWithOptions(":0", func() string { return "8.8.8.8" }, NewInMemoryCache(10), &Options{AllowedNetworks: []*net.IPNet{network}})
+	require.NoError(t, err)
+	defer s.Close()
+
+	require.NotNil(t, queryFrom(t, s, net.IPv4(10, 0, 0, 2), "domain1."))
+	require.Nil(t, queryFrom(t, s, net.IPv4(192, 168, 0, 2), "domain1."), "query from outside allowed networks should be dropped")
+
+	q := &dns.Msg{}
+	q.SetQuestion("domain1.", dns.TypeA)
+	b, err := q.Pack()
+	require.NoError(t, err)
+	admitted, refusal := s.(*server).admit(b, unknownAddr{})
+	require.False(t, admitted, "clients with unknown IPs shouldn't be admitted when there are allowed networks")
+	require.Nil(t, refusal)
+
+	unrestricted, err := ListenWithCache(":0", func() string { return "8.8.8.8" }, NewInMemoryCache(10))
+	require.NoError(t, err)
+	defer unrestricted.Close()
+	admitted, _ = unrestricted.(*server).admit(b, unknownAddr{})
+	require.True(t, admitted, "clients with unknown IPs should be admitted when there are no allowed networks")
+}
+
+// unknownAddr is an address that doesn't have an IP, like ones from some userspace network stacks
+type unknownAddr struct{}
+
+func (unknownAddr) Network() string { return "netstack" }
+func (unknownAddr) String() string  { return "unknown" }
+
+func TestRefusalRateLimit(t *testing.T) {
+	deny, err := ParseNetworks("10.0.0.0/8")
+	require.NoError(t, err)
+	s, err := ListenWithOptions(":0", func() string { return "8.8.8.8" }, NewInMemoryCache(10), &Options{DeniedNetworks: deny, RefuseDenied: true})
+	require.NoError(t, err)
+	defer s.Close()
+
+	client := net.IPv4(10, 0, 0, 2)
+	resp := queryFrom(t, s, client, "domain1.")
+	require.NotNil(t, resp)
+	require.Equal(t, dns.RcodeRefused, resp.Rcode)
+	for i := 0; i < 5; i++ {
+		require.Nil(t, queryFrom(t, s, client, "domain1."), "refusals beyond the rate limit should be dropped")
+	}
+	require.NotNil(t, queryFrom(t, s, net.IPv4(10, 0, 0, 3), "domain1."), "other clients should still be refused")
+}
+
+func TestDeniedNetworks(t *testing.T) {
+	allow, err := ParseNetworks("10.0.0.0/24", "192.168.0.7")
+	require.NoError(t, err)
+	deny, err := ParseNetworks("10.0.0.128/25")
+	require.NoError(t, err)
+	_, err = ParseNetworks("10.0.0.0/33")
+	require.Error(t, err)
+
+	for _, refuse := range []bool{false, true} {
+		opts := &Options{AllowedNetworks: allow, DeniedNetworks: deny, RefuseDenied: refuse}
+		s, err := ListenWithOptions(":0", func() string { return "8.8.8.8" }, NewInMemoryCache(10), opts)
+		require.NoError(t, err)
+		defer s.Close()
+
+		require.Len(t, queryFrom(t, s, net.IPv4(10, 0, 0, 2), "domain1.").Answer, 1)
+		require.Len(t, queryFrom(t, s, net.IPv4(192, 168, 0, 7), "domain1.").Answer, 1)
+		for _, client := range []net.IP{net.IPv4(10, 0, 0, 130), net.IPv4(192, 168, 0, 8)} {
+			resp := queryFrom(t, s, client, "domain1.")
+			if refuse {
+				require.NotNil(t, resp, "query from %v should be refused", client)
+				require.Equal(t, dns.RcodeRefused, resp.Rcode)
+				require.Empty(t, resp.Answer)
+			} else {
+				require.Nil(t, resp, "query from %v should be dropped", client)
+			}
+		}
+	}
+}
+
+func TestDeniedNetworksServe(t *testing.T) {
+	deny, err := ParseNetworks("127.0.0.0/8")
+	require.NoError(t, err)
+
+	s, err := ListenWithOptions("127.0.0.1:0", func() string { return "8.8.8.8" }, NewInMemoryCache(10), &Options{DeniedNetworks: deny, RefuseDenied: true})
+	require.NoError(t, err)
+	defer s.Close()
+	go s.Serve()
+	q := &dns.Msg{}
+	q.SetQuestion("domain1.", dns.TypeA)
+	a, err := dns.Exchange(q, s.LocalAddr().String())
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeRefused, a.Rcode, "UDP query should be refused")
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s = NewWithListener(l, func() string { return "8.8.8.8" }, NewInMemoryCache(10), &Options{DeniedNetworks: deny, RefuseDenied: true})
+	defer s.Close()
+	go s.Serve()
+	conn, err := dns.Dial("tcp", s.LocalAddr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.WriteMsg(q))
+	a, err = conn.ReadMsg()
+	require.NoError(t, err)
+	require.Equal(t, dns.RcodeRefused, a.Rcode, "TCP query should be refused")
+
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s = NewWithListener(l, func() string { return "8.8.8.8" }, NewInMemoryCache(10), &Options{DeniedNetworks: deny})
+	defer s.Close()
+	go s.Serve()
+	conn, err = dns.Dial("tcp", s.LocalAddr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.WriteMsg(q)
+	_, err = conn.ReadMsg()
+	require.Error(t, err, "TCP connection should be closed")
+}
+
+// queryFrom sends an A query for name from the given client through ProcessPacket, returning nil if it was dropped
+func queryFrom(t *testing.T, s Server, client net.IP, name string) *dns.Msg {
+	q := &dns.Msg{}
+	q.SetQuestion(name, dns.TypeA)
+	out, err := s.ProcessPacket(makeUDPPacket(t, client, q))
+	require.NoError(t, err)
+	if out == nil {
+		return nil
+	}
+	resp := &dns.Msg{}
+	require.NoError(t, resp.Unpack(out[ipv4HeaderLen+udpHeaderLen:]))
+	return resp
+}
+
+// makeUDPPacket wraps the given query in an IPv4 UDP packet from client to 10.0.0.1
+func makeUDPPacket(t testing.TB, client net.IP, q *dns.Msg) []byte {
+	b, err := q.Pack()
+	require.NoError(t, err)
+	packet := make([]byte, ipv4HeaderLen+udpHeaderLen+len(b))
+	packet[0] = 4<<4 | ipv4HeaderLen/4
+	binary.BigEndian.PutUint16(packet[2:], uint16(len(packet)))
+	packet[9] = protocolUDP
+	copy(packet[12:], client.To4())
+	copy(packet[16:], net.IPv4(10, 0, 0, 1).To4())
+	writeUDP(packet[ipv4HeaderLen:], 5353, 53, b, 0)
+	return packet
+}
+
+func TestQueryValidation(t *testing.T) {
+	s, err := ListenWithCache(":0", func() string { return "127.0.0.1:1" }, NewInMemoryCache(10))
+	require.NoError(t, err)
+	defer s.Close()
+
+	pack := func(q *dns.Msg) []byte {
+		b, err := q.Pack()
+		require.NoError(t, err)
+		return b
+	}
+	query := func(name string) *dns.Msg {
+		q := &dns.Msg{}
+		q.Id = 1234
+		q.SetQuestion(name, dns.TypeA)
+		q.Id = 1234
+		return q
+	}
+
+	response := query("domain1.")
+	response.Response = true
+	update := query("domain1.")
+	update.Opcode = dns.OpcodeUpdate
+	noQuestions := query("domain1.")
+	noQuestions.Question = nil
+	manyQuestions := query("domain1.")
+	for i := 0; i < maxQuestions; i++ {
+		manyQuestions.Question = append(manyQuestions.Question, manyQuestions.Question[0])
+	}
+	truncated := pack(query("domain1."))
+	truncated = truncated[:len(truncated)-3]
+	// 5 labels of 63 bytes each exceed the maximum name length
+	longName := pack(query("domain1."))[:dnsHeaderLen]
+	for i := 0; i < 5; i++ {
+		longName = append(longName, 63)
+		longName = append(longName, bytes.Repeat([]byte("a"), 63)...)
+	}
+	longName = append(longName, 0, 0, 1, 0, 1)
+
+	for _, test := range []struct {
+		name  string
+		query []byte
+		rcode int
+		err   bool
+	}{
+		{"valid", pack(query("domain1.")), dns.RcodeSuccess, false},
+		{"short", []byte{1, 2, 3}, 0, true},
+		{"response", pack(response), 0, true},
+		{"update", pack(update), dns.RcodeNotImplemented, false},
+		{"no questions", pack(noQuestions), dns.RcodeFormatError, false},
+		{"too many questions", pack(manyQuestions), dns.RcodeFormatError, false},
+		{"truncated", truncated, dns.RcodeFormatError, false},
+		{"long name", longName, dns.RcodeFormatError, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			out, _, err := s.ProcessQuery(test.query)
+			if test.err {
+				require.ErrorIs(t, err, ErrInvalidQuery)
+				return
+			}
+			require.NoError(t, err)
+			resp := &dns.Msg{}
+			require.NoError(t, resp.Unpack(out))
+			require.True(t, resp.Response)
+			require.EqualValues(t, 1234, resp.Id)
+			require.Equal(t, test.rcode, resp.Rcode)
+			if test.rcode != dns.RcodeSuccess {
+				require.Empty(t, resp.Answer)
+			}
+		})
+	}
+
+	require.Equal(t, "", stripTrailingDot(""))
+}
+
+func FuzzProcessQuery(f *testing.F) {
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA, dns.TypePTR, dns.TypeHTTPS} {
+		q := &dns.Msg{}
+		q.SetQuestion("domain1.", qtype)
+		b, err := q.Pack()
+		require.NoError(f, err)
+		f.Add(b)
+	}
+	srp, err := makeSRPQuery("240.0.0.1").Pack()
+	require.NoError(f, err)
+	f.Add(srp)
+	f.Add([]byte{})
+
+	// forward unanswered questions to a closed port so that they fail fast
+	s, err := ListenWithCache(":0", func() string { return "127.0.0.1:1" }, NewInMemoryCache(10))
+	require.NoError(f, err)
+	f.Cleanup(func() { s.Close() })
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		out, _, err := s.ProcessQuery(b)
+		if err != nil {
+			return
+		}
+		resp := &dns.Msg{}
+		require.NoError(t, resp.Unpack(out), "response should be well-formed")
+		require.True(t, resp.Response)
+		require.Equal(t, binary.BigEndian.Uint16(b), resp.Id)
+	})
+}
+
+func FuzzProcessPacket(f *testing.F) {
+	q := &dns.Msg{}
+	q.SetQuestion("domain1.", dns.TypeA)
+	f.Add(makeUDPPacket(f, net.IPv4(10, 0, 0, 2), q))
+	f.Add([]byte{0x60})
+
+	s, err := ListenWithCache(":0", func() string { return "127.0.0.1:1" }, NewInMemoryCache(10))
+	require.NoError(f, err)
+	f.Cleanup(func() { s.Close() })
+
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		out, err := s.ProcessPacket(packet)
+		if err != nil || out == nil {
+			return
+		}
+		require.Equal(t, packet[0]>>4, out[0]>>4, "response should use the same IP version")
+	})
+}
+
+func fakeIPFor(t *testing.T, s Server, name string) net.IP {
+	ip, err := s.FakeIPFor(name)
+	require.NoError(t, err)
+	return ip
+}
+
+func requireFound(t *testing.T, expected bool, remove func(string) (bool, error), name string) {
+	found, err := remove(name)
+	require.NoError(t, err)
+	require.Equal(t, expected, found, "unexpected result removing %v", name)
+}
+
 func makeSRPQuery(ip string) *dns.Msg {
 	q := &dns.Msg{}
 	parts := strings.Split(ip, ".")
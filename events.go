@@ -0,0 +1,161 @@
+package dnsgrab
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// EventType identifies the kind of change described by an Event
+type EventType int
+
+const (
+	// EventMapped means that a name was mapped to a new fake IP
+	EventMapped EventType = iota
+
+	// EventRefreshed means that an existing mapping was queried again and marked fresh
+	EventRefreshed
+
+	// EventEvicted means that a mapping was evicted from the cache to stay within its size limit
+	EventEvicted
+
+	// EventExpired means that a mapping was removed from the cache because it exceeded its max age
+	EventExpired
+
+	// EventReassigned means that a mapping was dropped because its fake IP was handed out to a different name after
+	// the fake IP sequence wrapped around. It's always followed by an EventMapped for the new name.
+	EventReassigned
+
+	// EventRemoved means that a mapping was explicitly removed with Server.Remove or Server.RemoveIP
+	EventRemoved
+
+	// EventFlushed means that all mappings were explicitly removed with Server.Flush. Events of this type don't carry
+	// a Name or IP.
+	EventFlushed
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventMapped:
+		return "mapped"
+	case EventRefreshed:
+		return "refreshed"
+	case EventEvicted:
+		return "evicted"
+	case EventExpired:
+		return "expired"
+	case EventReassigned:
+		return "reassigned"
+	case EventRemoved:
+		return "removed"
+	case EventFlushed:
+		return "flushed"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(t))
+	}
+}
+
+// Event describes a change to the mapping between a name and its fake IP
+type Event struct {
+	Type EventType
+	Name string
+	IP   net.IP
+}
+
+func (e Event) String() string {
+	if e.Type == EventFlushed {
+		return e.Type.String()
+	}
+	return fmt.Sprintf("%v %v -> %v", e.Type, e.Name, e.IP)
+}
+
+// EvictionNotifier is optionally implemented by Caches that evict entries on their own in order to stay within a
+// size limit.
+type EvictionNotifier interface {
+	// OnEvicted registers a function that gets called for every evicted entry. Registering multiple functions keeps
+	// all of them, so that a Cache can be shared, for example by a TieredCache and a server.
+	OnEvicted(fn func(name string, ip []byte))
+}
+
+// ExpirationNotifier is optionally implemented by Caches that remove entries on their own once they exceed a max
+// age.
+type ExpirationNotifier interface {
+	// OnExpired registers a function that gets called for every expired entry. Registering multiple functions keeps
+	// all of them.
+	OnExpired(fn func(name string, ip []byte))
+}
+
+// notifyFuncs holds the functions registered with OnEvicted or OnExpired, which get called in the order in which
+// they were registered. It's safe for concurrent use.
+type notifyFuncs struct {
+	fns []func(name string, ip []byte)
+	mx  sync.RWMutex
+}
+
+func (n *notifyFuncs) add(fn func(name string, ip []byte)) {
+	n.mx.Lock()
+	n.fns = append(n.fns, fn)
+	n.mx.Unlock()
+}
+
+func (n *notifyFuncs) notify(name string, ip []byte) {
+	n.mx.RLock()
+	fns := n.fns
+	n.mx.RUnlock()
+	for _, fn := range fns {
+		fn(name, ip)
+	}
+}
+
+type subscribers struct {
+	handlers map[int]func(Event)
+	nextID   int
+	mx       sync.RWMutex
+}
+
+func (subs *subscribers) subscribe(handler func(Event)) func() {
+	subs.mx.Lock()
+	if subs.handlers == nil {
+		subs.handlers = make(map[int]func(Event))
+	}
+	id := subs.nextID
+	subs.nextID++
+	subs.handlers[id] = handler
+	subs.mx.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			subs.mx.Lock()
+			delete(subs.handlers, id)
+			subs.mx.Unlock()
+		})
+	}
+}
+
+func (subs *subscribers) emit(eventType EventType, name string, ip []byte) {
+	subs.mx.RLock()
+	if len(subs.handlers) == 0 {
+		subs.mx.RUnlock()
+		return
+	}
+	handlers := make([]func(Event), 0, len(subs.handlers))
+	for _, handler := range subs.handlers {
+		handlers = append(handlers, handler)
+	}
+	subs.mx.RUnlock()
+
+	for _, handler := range handlers {
+		// give each handler its own copy of the IP so that they can't interfere with each other or with the cache
+		handler(Event{Type: eventType, Name: name, IP: copyIP(ip)})
+	}
+}
+
+func copyIP(ip []byte) net.IP {
+	if ip == nil {
+		return nil
+	}
+	result := make(net.IP, len(ip))
+	copy(result, ip)
+	return result
+}
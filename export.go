@@ -0,0 +1,292 @@
+package dnsgrab
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/getlantern/dnsgrab/internal"
+)
+
+// ExportFormat identifies a format for exported cache contents
+type ExportFormat int
+
+const (
+	// FormatJSONLines is a human readable format consisting of a header line followed by one JSON object per entry
+	FormatJSONLines ExportFormat = iota
+
+	// FormatBinary is a compact binary format protected by a CRC32 checksum
+	FormatBinary
+)
+
+const (
+	exportFormatName = "dnsgrab"
+	exportVersion    = 1
+
+	// maxNameLength is the maximum length of a domain name in presentation format, without the trailing dot
+	maxNameLength = 253
+)
+
+var (
+	ErrInvalidExport = errors.New("invalid export")
+
+	binaryExportMagic = []byte("DNSGRAB\x00")
+)
+
+type exportHeader struct {
+	Format   string `json:"format"`
+	Version  int    `json:"version"`
+	Sequence uint32 `json:"sequence"`
+}
+
+type exportEntry struct {
+	Name  string    `json:"name"`
+	IP    string    `json:"ip"`
+	Fresh time.Time `json:"fresh"`
+}
+
+// Export writes the current sequence and all entries in the given cache to w. The cache must not be modified while
+// exporting, use Server.Export to export the cache of a running server.
+func Export(cache Cache, w io.Writer, format ExportFormat) error {
+	entries, err := entriesOf(cache)
+	if err != nil {
+		return err
+	}
+	sequence, err := cache.Sequence()
+	if err != nil {
+		return err
+	}
+	return writeExport(w, format, sequence, entries)
+}
+
+// Import replaces the contents and sequence of the given cache with previously exported ones read from r. The whole
+// export is validated before the cache is modified, so an invalid export leaves the cache untouched. The cache must
+// not be modified while importing, use Server.Import to import into the cache of a running server.
+func Import(cache Cache, r io.Reader, format ExportFormat) error {
+	sequence, entries, err := readExport(r, format)
+	if err != nil {
+		return err
+	}
+	return restore(cache, sequence, entries)
+}
+
+func restore(cache Cache, sequence uint32, entries []Entry) error {
+	if err := cache.Flush(); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := cache.Restore(entry.Name, entry.IP.To4(), entry.Fresh); err != nil {
+			return err
+		}
+	}
+	return cache.SetSequence(sequence)
+}
+
+func writeExport(w io.Writer, format ExportFormat, sequence uint32, entries []Entry) error {
+	switch format {
+	case FormatJSONLines:
+		return writeJSONLines(w, sequence, entries)
+	case FormatBinary:
+		return writeBinary(w, sequence, entries)
+	default:
+		return fmt.Errorf("unknown export format %d", format)
+	}
+}
+
+// readExport reads and validates an export. The returned entries are ordered from least to most recently used so
+// that restoring them in order preserves the relative freshness of entries.
+func readExport(r io.Reader, format ExportFormat) (sequence uint32, entries []Entry, err error) {
+	switch format {
+	case FormatJSONLines:
+		sequence, entries, err = readJSONLines(r)
+	case FormatBinary:
+		sequence, entries, err = readBinary(r)
+	default:
+		return 0, nil, fmt.Errorf("unknown export format %d", format)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := validateExport(sequence, entries); err != nil {
+		return 0, nil, err
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Fresh.Before(entries[j].Fresh)
+	})
+	return sequence, entries, nil
+}
+
+func validateExport(sequence uint32, entries []Entry) error {
+	if sequence < internal.MinIP || sequence > internal.MaxIP {
+		return fmt.Errorf("%w: sequence %v outside of fake IP range", ErrInvalidExport, internal.IntToIP(sequence))
+	}
+	names := make(map[string]bool, len(entries))
+	ips := make(map[uint32]bool, len(entries))
+	for i, entry := range entries {
+		if entry.Name == "" || len(entry.Name) > maxNameLength || stripTrailingDot(entry.Name) != entry.Name {
+			return fmt.Errorf("%w: entry %d has invalid name %q", ErrInvalidExport, i, entry.Name)
+		}
+		ip := entry.IP.To4()
+		if ip == nil {
+			return fmt.Errorf("%w: entry %d has invalid IP %v", ErrInvalidExport, i, entry.IP)
+		}
+		ipInt := internal.IPToInt(ip)
+		if ipInt < internal.MinIP || ipInt > internal.MaxIP {
+			return fmt.Errorf("%w: entry %d has IP %v outside of fake IP range", ErrInvalidExport, i, ip)
+		}
+		if entry.Fresh.IsZero() {
+			return fmt.Errorf("%w: entry %d is missing its freshness timestamp", ErrInvalidExport, i)
+		}
+		if names[entry.Name] {
+			return fmt.Errorf("%w: duplicate name %q", ErrInvalidExport, entry.Name)
+		}
+		if ips[ipInt] {
+			return fmt.Errorf("%w: duplicate IP %v", ErrInvalidExport, ip)
+		}
+		names[entry.Name] = true
+		ips[ipInt] = true
+	}
+	return nil
+}
+
+func writeJSONLines(w io.Writer, sequence uint32, entries []Entry) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	if err := enc.Encode(exportHeader{Format: exportFormatName, Version: exportVersion, Sequence: sequence}); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := enc.Encode(exportEntry{Name: entry.Name, IP: entry.IP.String(), Fresh: entry.Fresh}); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func readJSONLines(r io.Reader) (uint32, []Entry, error) {
+	scanner := bufio.NewScanner(r)
+	var header *exportHeader
+	var entries []Entry
+	for line := 1; scanner.Scan(); line++ {
+		b := bytes.TrimSpace(scanner.Bytes())
+		if len(b) == 0 {
+			continue
+		}
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		if header == nil {
+			header = &exportHeader{}
+			if err := dec.Decode(header); err != nil {
+				return 0, nil, fmt.Errorf("%w: bad header on line %d: %v", ErrInvalidExport, line, err)
+			}
+			if header.Format != exportFormatName || header.Version != exportVersion {
+				return 0, nil, fmt.Errorf("%w: unsupported format %q version %d", ErrInvalidExport, header.Format, header.Version)
+			}
+			continue
+		}
+		var entry exportEntry
+		if err := dec.Decode(&entry); err != nil {
+			return 0, nil, fmt.Errorf("%w: bad entry on line %d: %v", ErrInvalidExport, line, err)
+		}
+		ip := net.ParseIP(entry.IP)
+		if ip == nil {
+			return 0, nil, fmt.Errorf("%w: bad IP %q on line %d", ErrInvalidExport, entry.IP, line)
+		}
+		entries = append(entries, Entry{Name: entry.Name, IP: ip, Fresh: entry.Fresh})
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, nil, err
+	}
+	if header == nil {
+		return 0, nil, fmt.Errorf("%w: missing header", ErrInvalidExport)
+	}
+	return header.Sequence, entries, nil
+}
+
+// The binary format is laid out as follows, with all integers in big endian byte order:
+//
+//	magic (8 bytes) | version (1 byte) | sequence (4 bytes) | number of entries (4 bytes) | entries | CRC32 (4 bytes)
+//
+// with each entry being
+//
+//	IP (4 bytes) | fresh as unix nanos (8 bytes) | name length (uvarint) | name
+//
+// The CRC32 (IEEE) covers everything that precedes it.
+func writeBinary(w io.Writer, sequence uint32, entries []Entry) error {
+	var buf bytes.Buffer
+	buf.Write(binaryExportMagic)
+	buf.WriteByte(exportVersion)
+	writeUint32(&buf, sequence)
+	writeUint32(&buf, uint32(len(entries)))
+	for _, entry := range entries {
+		buf.Write(entry.IP.To4())
+		ts := make([]byte, 8)
+		internal.Endianness.PutUint64(ts, uint64(entry.Fresh.UnixNano()))
+		buf.Write(ts)
+		buf.Write(binary.AppendUvarint(nil, uint64(len(entry.Name))))
+		buf.WriteString(entry.Name)
+	}
+	writeUint32(&buf, crc32.ChecksumIEEE(buf.Bytes()))
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func readBinary(r io.Reader) (uint32, []Entry, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	headerLen := len(binaryExportMagic) + 1 + 4 + 4
+	if len(b) < headerLen+4 {
+		return 0, nil, fmt.Errorf("%w: truncated", ErrInvalidExport)
+	}
+	body, checksum := b[:len(b)-4], internal.Endianness.Uint32(b[len(b)-4:])
+	if crc32.ChecksumIEEE(body) != checksum {
+		return 0, nil, fmt.Errorf("%w: checksum mismatch", ErrInvalidExport)
+	}
+	if !bytes.Equal(body[:len(binaryExportMagic)], binaryExportMagic) {
+		return 0, nil, fmt.Errorf("%w: not a dnsgrab export", ErrInvalidExport)
+	}
+	body = body[len(binaryExportMagic):]
+	if version := body[0]; version != exportVersion {
+		return 0, nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidExport, version)
+	}
+	sequence := internal.Endianness.Uint32(body[1:])
+	count := internal.Endianness.Uint32(body[5:])
+	body = body[9:]
+
+	var entries []Entry
+	for i := uint32(0); i < count; i++ {
+		if len(body) < 12 {
+			return 0, nil, fmt.Errorf("%w: entry %d truncated", ErrInvalidExport, i)
+		}
+		ip := copyIP(body[:4])
+		fresh := time.Unix(0, int64(internal.Endianness.Uint64(body[4:12])))
+		body = body[12:]
+		nameLen, n := binary.Uvarint(body)
+		if n <= 0 || nameLen > uint64(len(body)-n) {
+			return 0, nil, fmt.Errorf("%w: entry %d has bad name length", ErrInvalidExport, i)
+		}
+		name := string(body[n : n+int(nameLen)])
+		body = body[n+int(nameLen):]
+		entries = append(entries, Entry{Name: name, IP: ip, Fresh: fresh})
+	}
+	if len(body) > 0 {
+		return 0, nil, fmt.Errorf("%w: %d trailing bytes", ErrInvalidExport, len(body))
+	}
+	return sequence, entries, nil
+}
+
+func writeUint32(buf *bytes.Buffer, i uint32) {
+	b := make([]byte, 4)
+	internal.Endianness.PutUint32(b, i)
+	buf.Write(b)
+}
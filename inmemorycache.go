@@ -1,7 +1,7 @@
 package dnsgrab
 
 import (
-	"container/list"
+	"time"
 
 	"github.com/getlantern/dnsgrab/internal"
 )
@@ -9,63 +9,105 @@ import (
 // inMemoryCache is a size bounded in-memory cache
 type inMemoryCache struct {
 	size      int
-	namesByIP map[uint32]*list.Element
-	ipsByName map[string]uint32
-	ll        *list.List
+	mappings  *internal.Mappings
 	sequence  uint32
+	onEvicted notifyFuncs
 }
 
 func NewInMemoryCache(size int) Cache {
 	return &inMemoryCache{
-		size:      size,
-		namesByIP: make(map[uint32]*list.Element, size),
-		ipsByName: make(map[string]uint32, size),
-		ll:        list.New(),
-		sequence:  internal.MinIP,
+		size:     size,
+		mappings: internal.NewMappings(),
+		sequence: internal.MinIP,
 	}
 }
 
-func (cache *inMemoryCache) NameByIP(ip []byte) (name string, found bool) {
-	e, found := cache.namesByIP[internal.IPToInt(ip)]
+func (cache *inMemoryCache) NameByIP(ip []byte) (name string, found bool, err error) {
+	mapping, found := cache.mappings.ByIP(internal.IPToInt(ip))
 	if !found {
-		return "", false
+		return "", false, nil
 	}
-	return e.Value.(string), true
+	return mapping.Name, true, nil
 }
 
-func (cache *inMemoryCache) IPByName(name string) (ip []byte, found bool) {
-	_ip, found := cache.ipsByName[name]
+func (cache *inMemoryCache) IPByName(name string) (ip []byte, found bool, err error) {
+	mapping, found := cache.mappings.ByName(name)
 	if !found {
-		return nil, false
+		return nil, false, nil
 	}
-	return internal.IntToIP(_ip), true
+	return internal.IntToIP(mapping.IP), true, nil
 }
 
-func (cache *inMemoryCache) Add(name string, ip []byte) {
-	ipInt := internal.IPToInt(ip)
-	// insert to front of LRU list
-	e := cache.ll.PushFront(name)
-	cache.namesByIP[ipInt] = e
-	cache.ipsByName[name] = ipInt
+func (cache *inMemoryCache) Add(name string, ip []byte) error {
+	return cache.Restore(name, ip, time.Now())
+}
+
+func (cache *inMemoryCache) Restore(name string, ip []byte, fresh time.Time) error {
+	// drops the name's previous IP as well as the IP's previous name if it's being reassigned after the sequence
+	// wrapped around
+	cache.mappings.Put(name, internal.IPToInt(ip), fresh)
 
 	// remove oldest from LRU list if necessary
-	if len(cache.namesByIP) > cache.size {
-		oldest := cache.ll.Back()
-		oldestName := oldest.Value.(string)
-		cache.ll.Remove(oldest)
-		oldestIP := cache.ipsByName[oldestName]
-		delete(cache.namesByIP, oldestIP)
-		delete(cache.ipsByName, oldestName)
+	if cache.mappings.Len() > cache.size {
+		oldest, _ := cache.mappings.Oldest()
+		cache.mappings.Remove(oldest)
+		cache.onEvicted.notify(oldest.Name, internal.IntToIP(oldest.IP))
+	}
+	return nil
+}
+
+func (cache *inMemoryCache) MarkFresh(name string, ip []byte) error {
+	if mapping, found := cache.mappings.ByIP(internal.IPToInt(ip)); found {
+		cache.mappings.Touch(mapping)
 	}
+	return nil
+}
+
+func (cache *inMemoryCache) Remove(name string) (ip []byte, found bool, err error) {
+	mapping, found := cache.mappings.ByName(name)
+	if !found {
+		return nil, false, nil
+	}
+	cache.mappings.Remove(mapping)
+	return internal.IntToIP(mapping.IP), true, nil
+}
+
+func (cache *inMemoryCache) RemoveIP(ip []byte) (name string, found bool, err error) {
+	mapping, found := cache.mappings.ByIP(internal.IPToInt(ip))
+	if !found {
+		return "", false, nil
+	}
+	cache.mappings.Remove(mapping)
+	return mapping.Name, true, nil
+}
+
+func (cache *inMemoryCache) Flush() error {
+	cache.mappings.Reset()
+	return nil
+}
+
+func (cache *inMemoryCache) Range(fn func(name string, ip []byte, fresh time.Time) bool) error {
+	// walk from most to least recently used
+	cache.mappings.Range(func(mapping *internal.Mapping) bool {
+		return fn(mapping.Name, internal.IntToIP(mapping.IP), mapping.Fresh)
+	})
+	return nil
+}
+
+func (cache *inMemoryCache) OnEvicted(fn func(name string, ip []byte)) {
+	cache.onEvicted.add(fn)
+}
+
+func (cache *inMemoryCache) Sequence() (uint32, error) {
+	return cache.sequence, nil
 }
 
-func (cache *inMemoryCache) MarkFresh(name string, ip []byte) {
-	e := cache.namesByIP[internal.IPToInt(ip)]
-	// move to front of LRU list
-	cache.ll.MoveToFront(e)
+func (cache *inMemoryCache) SetSequence(next uint32) error {
+	cache.sequence = next
+	return nil
 }
 
-func (cache *inMemoryCache) NextSequence() uint32 {
+func (cache *inMemoryCache) NextSequence() (uint32, error) {
 	// advance sequence
 	next := cache.sequence
 	cache.sequence++
@@ -73,5 +115,5 @@ func (cache *inMemoryCache) NextSequence() uint32 {
 		// wrap IP to stay within allowed range
 		cache.sequence = internal.MinIP
 	}
-	return next
+	return next, nil
 }
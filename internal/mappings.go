@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"container/list"
+	"time"
+)
+
+// Mapping is a single mapping between a name and an IP
+type Mapping struct {
+	Name  string
+	IP    uint32
+	Fresh time.Time
+
+	e *list.Element
+}
+
+// Mappings is an unbounded in-memory index of mappings by name and by IP, which also keeps track of the order in
+// which mappings were used. It makes sure that every name and every IP belongs to at most one mapping. It is not safe
+// for concurrent use.
+type Mappings struct {
+	byName map[string]*Mapping
+	byIP   map[uint32]*Mapping
+	ll     *list.List
+}
+
+func NewMappings() *Mappings {
+	return &Mappings{
+		byName: make(map[string]*Mapping),
+		byIP:   make(map[uint32]*Mapping),
+		ll:     list.New(),
+	}
+}
+
+func (m *Mappings) ByName(name string) (*Mapping, bool) {
+	mapping, found := m.byName[name]
+	return mapping, found
+}
+
+func (m *Mappings) ByIP(ip uint32) (*Mapping, bool) {
+	mapping, found := m.byIP[ip]
+	return mapping, found
+}
+
+// Put maps the given name to the given IP, dropping any existing mappings for either of them. Putting mappings that are
+// fresher or older than all others is cheap, while putting them in random order takes time linear in the number of
+// mappings.
+func (m *Mappings) Put(name string, ip uint32, fresh time.Time) *Mapping {
+	if existing, found := m.byName[name]; found {
+		m.Remove(existing)
+	}
+	if existing, found := m.byIP[ip]; found {
+		m.Remove(existing)
+	}
+	mapping := &Mapping{Name: name, IP: ip, Fresh: fresh}
+	if back := m.ll.Back(); back == nil || back.Value.(*Mapping).Fresh.After(fresh) {
+		// older than all other mappings
+		mapping.e = m.ll.PushBack(mapping)
+	} else {
+		// insert ahead of the first mapping that's no fresher, which is the front unless putting older mappings. There
+		// is one, since the back is no fresher.
+		for mark := m.ll.Front(); mapping.e == nil; mark = mark.Next() {
+			if !mark.Value.(*Mapping).Fresh.After(fresh) {
+				mapping.e = m.ll.InsertBefore(mapping, mark)
+			}
+		}
+	}
+	m.byName[name] = mapping
+	m.byIP[ip] = mapping
+	return mapping
+}
+
+// Touch marks the given mapping as fresh as of now, making it the most recently used one
+func (m *Mappings) Touch(mapping *Mapping) {
+	mapping.Fresh = time.Now()
+	m.ll.MoveToFront(mapping.e)
+}
+
+// Oldest returns the least recently used mapping
+func (m *Mappings) Oldest() (*Mapping, bool) {
+	e := m.ll.Back()
+	if e == nil {
+		return nil, false
+	}
+	return e.Value.(*Mapping), true
+}
+
+func (m *Mappings) Remove(mapping *Mapping) {
+	delete(m.byName, mapping.Name)
+	delete(m.byIP, mapping.IP)
+	m.ll.Remove(mapping.e)
+}
+
+func (m *Mappings) Len() int {
+	return len(m.byName)
+}
+
+// Range calls fn for every mapping, from most to least recently used, until fn returns false. fn may remove the
+// mapping it's given.
+func (m *Mappings) Range(fn func(mapping *Mapping) bool) {
+	for e := m.ll.Front(); e != nil; {
+		next := e.Next()
+		if !fn(e.Value.(*Mapping)) {
+			return
+		}
+		e = next
+	}
+}
+
+func (m *Mappings) Reset() {
+	m.byName = make(map[string]*Mapping)
+	m.byIP = make(map[uint32]*Mapping)
+	m.ll.Init()
+}
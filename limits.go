@@ -0,0 +1,195 @@
+package dnsgrab
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// clientCleanupInterval is how often state about clients that haven't queried recently is discarded
+	clientCleanupInterval = time.Minute
+
+	// maxTrackedClients is the number of clients that a clientLimiter keeps state for. Since source addresses are
+	// easily spoofed, the least recently seen clients are forgotten beyond that, which resets their limits.
+	maxTrackedClients = 65536
+
+	// ipv6ClientPrefixLen is the prefix length of the IPv6 networks that are treated as a single client, since hosts
+	// usually get a whole /64 to pick addresses from
+	ipv6ClientPrefixLen = 64
+)
+
+var (
+	// ErrAllocationLimited means that a client asked for more new fake IPs than Options.AllocationLimit allows.
+	// Questions that fail with it are answered with REFUSED.
+	ErrAllocationLimited = errors.New("allocation limit exceeded")
+)
+
+type clientContextKey struct{}
+
+// withClient returns a context that carries the IP of the client that sent the query being processed
+func withClient(ctx context.Context, ip net.IP) context.Context {
+	return context.WithValue(ctx, clientContextKey{}, ip)
+}
+
+// clientFromContext returns the IP of the client carried by ctx, or nil if there is none
+func clientFromContext(ctx context.Context) net.IP {
+	ip, _ := ctx.Value(clientContextKey{}).(net.IP)
+	return ip
+}
+
+// clientIP returns the IP of the given address, or nil if it doesn't have one
+func clientIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	case *net.IPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// clientLimiter enforces Options.RateLimit and Options.AllocationLimit for each client IP
+type clientLimiter struct {
+	rate               float64
+	burst              float64
+	allocationLimit    int
+	allocationInterval time.Duration
+	clients            map[string]*clientState
+	ll                 *list.List
+	lastCleanup        time.Time
+	mx                 sync.Mutex
+}
+
+type clientState struct {
+	key string
+	e   *list.Element
+
+	// token bucket for queries
+	tokens      float64
+	lastQueried time.Time
+
+	// allocations made in the current allocation interval
+	allocations      int
+	allocationsSince time.Time
+}
+
+func newClientLimiter(opts *Options) *clientLimiter {
+	if opts.RateLimit <= 0 && opts.AllocationLimit <= 0 {
+		return nil
+	}
+	burst := float64(opts.RateBurst)
+	if burst < 1 {
+		burst = opts.RateLimit
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	interval := opts.AllocationInterval
+	if interval <= 0 {
+		interval = DefaultAllocationInterval
+	}
+	return &clientLimiter{
+		rate:               opts.RateLimit,
+		burst:              burst,
+		allocationLimit:    opts.AllocationLimit,
+		allocationInterval: interval,
+		clients:            make(map[string]*clientState),
+		ll:                 list.New(),
+		lastCleanup:        time.Now(),
+	}
+}
+
+// client returns the state for the given client, creating it if necessary. Must be called with mx held.
+func (l *clientLimiter) client(ip net.IP, now time.Time) *clientState {
+	if now.Sub(l.lastCleanup) > clientCleanupInterval {
+		l.cleanup(now)
+	}
+	key := clientKey(ip)
+	state := l.clients[key]
+	if state != nil {
+		l.ll.MoveToFront(state.e)
+		return state
+	}
+	if len(l.clients) >= maxTrackedClients {
+		l.forget(l.ll.Back().Value.(*clientState))
+	}
+	state = &clientState{key: key, tokens: l.burst, lastQueried: now, allocationsSince: now}
+	state.e = l.ll.PushFront(state)
+	l.clients[key] = state
+	return state
+}
+
+// forget discards the state of the given client. Must be called with mx held.
+func (l *clientLimiter) forget(state *clientState) {
+	l.ll.Remove(state.e)
+	delete(l.clients, state.key)
+}
+
+// clientKey returns the key under which the state of the given client is kept. IPv6 clients are keyed by their
+// network, so that a single host can't get around its limits by cycling through its addresses.
+func clientKey(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return string(ip4)
+	}
+	return string(ip.Mask(net.CIDRMask(ipv6ClientPrefixLen, 8*net.IPv6len)))
+}
+
+// cleanup discards the state of clients that have a full token bucket and no allocations in the current interval,
+// which is the same as not having any state. Must be called with mx held.
+func (l *clientLimiter) cleanup(now time.Time) {
+	for _, state := range l.clients {
+		refilled := l.rate <= 0 || state.tokens+now.Sub(state.lastQueried).Seconds()*l.rate >= l.burst
+		if refilled && now.Sub(state.allocationsSince) >= l.allocationInterval {
+			l.forget(state)
+		}
+	}
+	l.lastCleanup = now
+}
+
+// allowQuery indicates whether the given client may send another query right now
+func (l *clientLimiter) allowQuery(ip net.IP) bool {
+	if l == nil || l.rate <= 0 || ip == nil {
+		return true
+	}
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	now := time.Now()
+	state := l.client(ip, now)
+	state.tokens += now.Sub(state.lastQueried).Seconds() * l.rate
+	if state.tokens > l.burst {
+		state.tokens = l.burst
+	}
+	state.lastQueried = now
+	if state.tokens < 1 {
+		return false
+	}
+	state.tokens--
+	return true
+}
+
+// allowAllocation indicates whether the given client may have another fake IP allocated for it right now, counting
+// the allocation if so
+func (l *clientLimiter) allowAllocation(ip net.IP) bool {
+	if l == nil || l.allocationLimit <= 0 || ip == nil {
+		return true
+	}
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	now := time.Now()
+	state := l.client(ip, now)
+	if now.Sub(state.allocationsSince) >= l.allocationInterval {
+		state.allocations = 0
+		state.allocationsSince = now
+	}
+	if state.allocations >= l.allocationLimit {
+		return false
+	}
+	state.allocations++
+	return true
+}
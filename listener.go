@@ -0,0 +1,110 @@
+package dnsgrab
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// tcpIdleTimeout is how long DNS over TCP connections may sit idle between queries before they're closed
+	tcpIdleTimeout = 10 * time.Second
+)
+
+// serveListener accepts DNS over TCP connections until the listener is closed, then waits for queries that are being
+// processed to be answered. At most Options.Concurrency connections are handled at once, further ones wait to be
+// accepted until others are closed.
+func (s *server) serveListener() error {
+	slots := make(chan interface{}, s.opts.Concurrency)
+	var mx sync.Mutex
+	conns := make(map[net.Conn]bool)
+	var wg sync.WaitGroup
+	defer func() {
+		// stop waiting for further queries on open connections and let in-flight ones finish
+		mx.Lock()
+		for conn := range conns {
+			conn.SetReadDeadline(time.Now())
+		}
+		mx.Unlock()
+		wg.Wait()
+	}()
+
+	var backoff time.Duration
+	for {
+		select {
+		case slots <- nil:
+		case <-s.closing:
+			return ErrServerClosed
+		}
+		conn, err := s.listener.Accept()
+		if err != nil {
+			<-slots
+			if s.isClosing() {
+				return ErrServerClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			// errors like running out of file descriptors are usually temporary
+			backoff = nextBackoff(backoff)
+			log.Errorf("Error accepting DNS connection, retrying in %v: %v", backoff, err)
+			if !s.sleep(backoff) {
+				return ErrServerClosed
+			}
+			continue
+		}
+		backoff = 0
+		if !s.admits(clientIP(conn.RemoteAddr())) && !s.opts.RefuseDenied {
+			// nothing would be answered anyway
+			log.Debugf("Closing connection from %v, which isn't in an allowed network", conn.RemoteAddr())
+			conn.Close()
+			<-slots
+			continue
+		}
+		mx.Lock()
+		conns[conn] = true
+		mx.Unlock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.handleConn(conn)
+			mx.Lock()
+			delete(conns, conn)
+			mx.Unlock()
+			<-slots
+		}()
+	}
+}
+
+// handleConn processes length-prefixed queries on a DNS over TCP connection one at a time
+func (s *server) handleConn(conn net.Conn) {
+	defer conn.Close()
+	var length [2]byte
+	for !s.isClosing() {
+		conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return
+		}
+		b := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return
+		}
+		admitted, bo := s.admit(b, conn.RemoteAddr())
+		if admitted {
+			bo = s.response(b, conn.RemoteAddr(), "tcp")
+		}
+		if bo == nil {
+			continue
+		}
+		out := make([]byte, 2+len(bo))
+		binary.BigEndian.PutUint16(out, uint16(len(bo)))
+		copy(out[2:], bo)
+		if _, err := conn.Write(out); err != nil {
+			log.Errorf("Error responding to DNS query: %v", err)
+			return
+		}
+	}
+}
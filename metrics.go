@@ -0,0 +1,114 @@
+package dnsgrab
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/getlantern/dns"
+)
+
+// Outcome describes how a question was handled
+type Outcome int
+
+const (
+	// OutcomeGrabbed means the question was answered from the cache, with a fake IP or the name behind one
+	OutcomeGrabbed Outcome = iota
+
+	// OutcomeForwarded means the question was passed along to the upstream DNS server
+	OutcomeForwarded
+
+	// OutcomeDropped means the question was deliberately left unanswered
+	OutcomeDropped
+
+	// OutcomeFailed means the question was answered with SERVFAIL because of an error
+	OutcomeFailed
+
+	// OutcomeRefused means the question was answered with REFUSED
+	OutcomeRefused
+)
+
+func (o Outcome) String() string {
+	switch o {
+	case OutcomeGrabbed:
+		return "grabbed"
+	case OutcomeForwarded:
+		return "forwarded"
+	case OutcomeDropped:
+		return "dropped"
+	case OutcomeFailed:
+		return "failed"
+	case OutcomeRefused:
+		return "refused"
+	default:
+		return fmt.Sprintf("outcome(%d)", int(o))
+	}
+}
+
+// Metrics receives measurements from a server. Implementations must be safe for concurrent use and return quickly,
+// since they're called while processing queries. See the separate github.com/getlantern/dnsgrab/prommetrics module
+// for a Prometheus implementation.
+type Metrics interface {
+	// QuestionHandled is called for every question with its type (like "A") and how it was handled. Types that the
+	// dns package doesn't know are all reported as "other", so that clients can't create arbitrarily many types.
+	QuestionHandled(qtype string, outcome Outcome)
+
+	// UpstreamExchanged is called for every exchange with an upstream DNS server, with err set if it failed
+	UpstreamExchanged(server string, latency time.Duration, err error)
+
+	// CacheLookedUp is called whenever the cache is checked for an existing fake IP, with whether one was found
+	CacheLookedUp(hit bool)
+
+	// CacheChanged is called for every change to the cache with the number of entries in the cache after the change
+	CacheChanged(event EventType, size int)
+
+	// SequenceAdvanced is called whenever a fake IP is allocated, with whether the sequence wrapped around to the
+	// beginning of the fake IP range since the last allocation
+	SequenceAdvanced(next uint32, wrapped bool)
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) QuestionHandled(qtype string, outcome Outcome)                     {}
+func (noopMetrics) UpstreamExchanged(server string, latency time.Duration, err error) {}
+func (noopMetrics) CacheLookedUp(hit bool)                                            {}
+func (noopMetrics) CacheChanged(event EventType, size int)                            {}
+func (noopMetrics) SequenceAdvanced(next uint32, wrapped bool)                        {}
+
+// qtypeLabel is like qtypeString, but returns "other" for unknown types
+func qtypeLabel(qtype uint16) string {
+	if s, found := dns.TypeToString[qtype]; found {
+		return s
+	}
+	return "other"
+}
+
+func qtypeString(qtype uint16) string {
+	if s, found := dns.TypeToString[qtype]; found {
+		return s
+	}
+	return fmt.Sprintf("TYPE%d", qtype)
+}
+
+// trackCacheSize keeps track of the number of entries in the cache based on events and reports changes to metrics
+func (s *server) trackCacheSize() {
+	size := 0
+	s.cache.Range(func(name string, ip []byte, fresh time.Time) bool {
+		size++
+		return true
+	})
+	var mx sync.Mutex
+	s.subscribers.subscribe(func(e Event) {
+		mx.Lock()
+		defer mx.Unlock()
+		switch e.Type {
+		case EventMapped:
+			size++
+		case EventEvicted, EventExpired, EventRemoved, EventReassigned:
+			size--
+		case EventFlushed:
+			size = 0
+		}
+		s.metrics.CacheChanged(e.Type, size)
+	})
+}
@@ -0,0 +1,171 @@
+package dnsgrab
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+const (
+	ipv4HeaderLen = 20
+	ipv6HeaderLen = 40
+	udpHeaderLen  = 8
+	protocolUDP   = 17
+	responseTTL   = 64
+)
+
+var (
+	// ErrInvalidPacket means that a packet passed to ProcessPacket isn't a well-formed IPv4 or IPv6 UDP packet, or uses
+	// features that aren't supported, like fragmentation or IPv6 extension headers
+	ErrInvalidPacket = errors.New("invalid packet")
+)
+
+func (s *server) ProcessPacket(packet []byte) ([]byte, error) {
+	if len(packet) == 0 {
+		return nil, fmt.Errorf("%w: empty", ErrInvalidPacket)
+	}
+	switch packet[0] >> 4 {
+	case 4:
+		return s.processIPv4Packet(packet)
+	case 6:
+		return s.processIPv6Packet(packet)
+	default:
+		return nil, fmt.Errorf("%w: unknown IP version %d", ErrInvalidPacket, packet[0]>>4)
+	}
+}
+
+func (s *server) processIPv4Packet(packet []byte) ([]byte, error) {
+	if len(packet) < ipv4HeaderLen {
+		return nil, fmt.Errorf("%w: truncated IPv4 header", ErrInvalidPacket)
+	}
+	headerLen := int(packet[0]&0x0f) * 4
+	totalLen := int(binary.BigEndian.Uint16(packet[2:]))
+	if headerLen < ipv4HeaderLen || totalLen < headerLen || totalLen > len(packet) {
+		return nil, fmt.Errorf("%w: bad IPv4 lengths", ErrInvalidPacket)
+	}
+	if binary.BigEndian.Uint16(packet[6:])&0x3fff != 0 {
+		// either more fragments follow or this isn't the first fragment
+		return nil, fmt.Errorf("%w: fragmented", ErrInvalidPacket)
+	}
+	if packet[9] != protocolUDP {
+		return nil, fmt.Errorf("%w: protocol %d isn't UDP", ErrInvalidPacket, packet[9])
+	}
+	src, dst := packet[12:16], packet[16:20]
+
+	srcPort, dstPort, query, err := parseUDP(packet[headerLen:totalLen])
+	if err != nil {
+		return nil, err
+	}
+	answer := s.packetResponse(query, src, srcPort)
+	if answer == nil {
+		return nil, nil
+	}
+
+	out := make([]byte, ipv4HeaderLen+udpHeaderLen+len(answer))
+	out[0] = 4<<4 | ipv4HeaderLen/4
+	binary.BigEndian.PutUint16(out[2:], uint16(len(out)))
+	out[8] = responseTTL
+	out[9] = protocolUDP
+	copy(out[12:], dst)
+	copy(out[16:], src)
+	binary.BigEndian.PutUint16(out[10:], ^checksum(0, out[:ipv4HeaderLen]))
+	writeUDP(out[ipv4HeaderLen:], dstPort, srcPort, answer, pseudoHeaderSum(dst, src, len(out)-ipv4HeaderLen))
+	return out, nil
+}
+
+func (s *server) processIPv6Packet(packet []byte) ([]byte, error) {
+	if len(packet) < ipv6HeaderLen {
+		return nil, fmt.Errorf("%w: truncated IPv6 header", ErrInvalidPacket)
+	}
+	payloadLen := int(binary.BigEndian.Uint16(packet[4:]))
+	if ipv6HeaderLen+payloadLen > len(packet) {
+		return nil, fmt.Errorf("%w: bad IPv6 payload length", ErrInvalidPacket)
+	}
+	if packet[6] != protocolUDP {
+		return nil, fmt.Errorf("%w: next header %d isn't UDP", ErrInvalidPacket, packet[6])
+	}
+	src, dst := packet[8:24], packet[24:40]
+
+	srcPort, dstPort, query, err := parseUDP(packet[ipv6HeaderLen : ipv6HeaderLen+payloadLen])
+	if err != nil {
+		return nil, err
+	}
+	answer := s.packetResponse(query, src, srcPort)
+	if answer == nil {
+		return nil, nil
+	}
+
+	out := make([]byte, ipv6HeaderLen+udpHeaderLen+len(answer))
+	out[0] = 6 << 4
+	binary.BigEndian.PutUint16(out[4:], uint16(len(out)-ipv6HeaderLen))
+	out[6] = protocolUDP
+	out[7] = responseTTL
+	copy(out[8:], dst)
+	copy(out[24:], src)
+	writeUDP(out[ipv6HeaderLen:], dstPort, srcPort, answer, pseudoHeaderSum(dst, src, len(out)-ipv6HeaderLen))
+	return out, nil
+}
+
+// packetResponse returns the response to a query from the given source address and port, or nil if it should be
+// dropped
+func (s *server) packetResponse(query []byte, src []byte, srcPort uint16) []byte {
+	client := &net.UDPAddr{IP: net.IP(append([]byte(nil), src...)), Port: int(srcPort)}
+	if admitted, refusal := s.admit(query, client); !admitted {
+		return refusal
+	}
+	return s.response(query, client, "udp")
+}
+
+// parseUDP returns the ports and payload of a UDP datagram. Checksums aren't verified, since network stacks commonly
+// leave that to hardware.
+func parseUDP(datagram []byte) (srcPort, dstPort uint16, payload []byte, err error) {
+	if len(datagram) < udpHeaderLen {
+		return 0, 0, nil, fmt.Errorf("%w: truncated UDP header", ErrInvalidPacket)
+	}
+	length := int(binary.BigEndian.Uint16(datagram[4:]))
+	if length < udpHeaderLen || length > len(datagram) {
+		return 0, 0, nil, fmt.Errorf("%w: bad UDP length", ErrInvalidPacket)
+	}
+	return binary.BigEndian.Uint16(datagram), binary.BigEndian.Uint16(datagram[2:]), datagram[udpHeaderLen:length], nil
+}
+
+// writeUDP writes a UDP header followed by payload into out, which must be exactly large enough to hold both
+func writeUDP(out []byte, srcPort, dstPort uint16, payload []byte, pseudoHeaderSum uint32) {
+	binary.BigEndian.PutUint16(out, srcPort)
+	binary.BigEndian.PutUint16(out[2:], dstPort)
+	binary.BigEndian.PutUint16(out[4:], uint16(len(out)))
+	copy(out[udpHeaderLen:], payload)
+	sum := ^checksum(pseudoHeaderSum, out)
+	if sum == 0 {
+		// zero means no checksum, so a computed zero is sent as all ones
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(out[6:], sum)
+}
+
+// pseudoHeaderSum sums the parts of the IPv4 or IPv6 pseudo header that's included in UDP checksums
+func pseudoHeaderSum(src, dst []byte, udpLen int) uint32 {
+	sum := partialSum(0, src)
+	sum = partialSum(sum, dst)
+	return sum + protocolUDP + uint32(udpLen)
+}
+
+func partialSum(sum uint32, b []byte) uint32 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	return sum
+}
+
+// checksum computes the ones' complement sum of b on top of the given initial sum, folded to 16 bits
+func checksum(initial uint32, b []byte) uint16 {
+	sum := partialSum(initial, b)
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return uint16(sum)
+}
@@ -0,0 +1,117 @@
+package persistentcache
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// minKeyLen is the minimum length of keys passed in Options.Key
+	minKeyLen = 16
+
+	// keyCheckLen is the length of the value stored alongside encrypted data to recognize the key it was encrypted with
+	keyCheckLen = 16
+)
+
+var (
+	// ErrWrongKey means that a database or log was encrypted with a different key than the one in Options.Key, or
+	// that it's encrypted but no key was given
+	ErrWrongKey = errors.New("database was encrypted with a different key")
+
+	// nonceSource is where nonces are read from
+	nonceSource = rand.Reader
+)
+
+// sealer encrypts values and hashes names when a key was given in Options.Key. A nil sealer leaves both as they are.
+type sealer struct {
+	aead     cipher.AEAD
+	hashKey  []byte
+	keyCheck []byte
+}
+
+// newSealer derives separate keys for encryption, hashing names and recognizing the key from the given key. Returns nil
+// if the key is empty.
+func newSealer(key []byte) (*sealer, error) {
+	if len(key) == 0 {
+		return nil, nil
+	}
+	if len(key) < minKeyLen {
+		return nil, fmt.Errorf("key must be at least %d bytes long", minKeyLen)
+	}
+	block, err := aes.NewCipher(deriveKey(key, "dnsgrab encryption"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &sealer{
+		aead:     aead,
+		hashKey:  deriveKey(key, "dnsgrab name hash"),
+		keyCheck: deriveKey(key, "dnsgrab key check")[:keyCheckLen],
+	}, nil
+}
+
+func deriveKey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// seal encrypts the given value, prefixing it with a random nonce. The value can only be opened with the same
+// additional data, which binds it to the key it's stored under so that values can't be swapped between keys.
+func (s *sealer) seal(value, additionalData []byte) ([]byte, error) {
+	if s == nil {
+		return value, nil
+	}
+	nonce := make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(value)+s.aead.Overhead())
+	if _, err := io.ReadFull(nonceSource, nonce); err != nil {
+		return nil, fmt.Errorf("unable to generate nonce: %w", err)
+	}
+	return s.aead.Seal(nonce, nonce, value, additionalData), nil
+}
+
+// open decrypts a value encrypted with seal using the same additional data
+func (s *sealer) open(sealed, additionalData []byte) ([]byte, error) {
+	if s == nil {
+		return sealed, nil
+	}
+	if len(sealed) < s.aead.NonceSize() {
+		return nil, errors.New("encrypted value too short")
+	}
+	nonceSize := s.aead.NonceSize()
+	return s.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], additionalData)
+}
+
+// overhead is how much longer sealed values are than the original ones
+func (s *sealer) overhead() int {
+	if s == nil {
+		return 0
+	}
+	return s.aead.NonceSize() + s.aead.Overhead()
+}
+
+// nameKey returns the key under which the given name is stored, which is a keyed hash of the name when encrypting
+func (s *sealer) nameKey(name string) []byte {
+	if s == nil {
+		return []byte(name)
+	}
+	mac := hmac.New(sha256.New, s.hashKey)
+	mac.Write([]byte(name))
+	return mac.Sum(nil)
+}
+
+// checkKey makes sure that data recorded with the given key check can be read with this sealer's key
+func (s *sealer) checkKey(keyCheck []byte) error {
+	if s == nil || !hmac.Equal(keyCheck, s.keyCheck) {
+		return ErrWrongKey
+	}
+	return nil
+}
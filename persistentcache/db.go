@@ -0,0 +1,446 @@
+package persistentcache
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"errors"
+	"net"
+	"os"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/getlantern/dnsgrab/internal"
+)
+
+var (
+	namesByIPBucket = []byte("namesByIP")
+	ipsByNameBucket = []byte("ipsByName")
+
+	// errNotEncrypted means that a key was given for a database that isn't encrypted
+	errNotEncrypted = errors.New("database isn't encrypted")
+)
+
+type entry []byte
+
+func newEntry(value []byte, ts time.Time) []byte {
+	e := make(entry, 8+len(value))
+	copy(e[8:], value)
+	internal.Endianness.PutUint64(e, uint64(ts.UnixNano()))
+	return e
+}
+
+func (e entry) tsNanos() time.Duration {
+	return time.Duration(internal.Endianness.Uint64(e))
+}
+
+func (e entry) fresh() time.Time {
+	return time.Unix(0, int64(e.tsNanos()))
+}
+
+func (e entry) value() []byte {
+	// We have to copy any byte arrays returned by bolt since those are only valid during the lifetime of a transaction.
+	// See https://pkg.go.dev/go.etcd.io/bbolt/#Bucket.Get
+	return copySlice(e[8:])
+}
+
+func copySlice(b []byte) []byte {
+	result := make([]byte, len(b))
+	copy(result, b)
+	return result
+}
+
+// nameRecord encodes the ipsByName record for a mapping. When encrypting, the key is only a hash of the name, so the
+// name is included in the value.
+func nameRecord(s *sealer, mapping *internal.Mapping) (key []byte, value []byte, err error) {
+	value = internal.IntToIP(mapping.IP)
+	if s != nil {
+		value = append(value, mapping.Name...)
+	}
+	key = s.nameKey(mapping.Name)
+	value, err = s.seal(newEntry(value, mapping.Fresh), key)
+	return key, value, err
+}
+
+// ipRecord encodes the namesByIP record for a mapping
+func ipRecord(s *sealer, mapping *internal.Mapping) (key []byte, value []byte, err error) {
+	key = internal.IntToIP(mapping.IP)
+	value, err = s.seal(newEntry([]byte(mapping.Name), mapping.Fresh), key)
+	return key, value, err
+}
+
+// parseNameRecord decodes an ipsByName record, returning false if it's malformed
+func parseNameRecord(s *sealer, k, v []byte) (name string, ip uint32, fresh time.Time, ok bool) {
+	v, err := s.open(v, k)
+	if err != nil || len(v) < 8+net.IPv4len {
+		return "", 0, time.Time{}, false
+	}
+	e := entry(v)
+	value := e.value()
+	if s == nil {
+		if len(value) != net.IPv4len {
+			return "", 0, time.Time{}, false
+		}
+		name = string(k)
+	} else {
+		name = string(value[net.IPv4len:])
+		if !hmac.Equal(k, s.nameKey(name)) {
+			return "", 0, time.Time{}, false
+		}
+	}
+	return name, internal.IPToInt(value[:net.IPv4len]), e.fresh(), true
+}
+
+// parseIPRecord decodes a namesByIP record, returning false if it's malformed
+func parseIPRecord(s *sealer, k, v []byte) (name string, ip uint32, fresh time.Time, ok bool) {
+	v, err := s.open(v, k)
+	if err != nil || len(k) != net.IPv4len || len(v) < 8 {
+		return "", 0, time.Time{}, false
+	}
+	e := entry(v)
+	return string(e.value()), internal.IPToInt(k), e.fresh(), true
+}
+
+// initBolt migrates the database to the current schema, creates the buckets and initializes the sequence if necessary
+func initBolt(db *bolt.DB, s *sealer) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		if err := migrate(tx, s); err != nil {
+			return err
+		}
+
+		if _, err := tx.CreateBucketIfNotExists(namesByIPBucket); err != nil {
+			return err
+		}
+
+		ipsByName, err := tx.CreateBucketIfNotExists(ipsByNameBucket)
+		if err != nil {
+			return err
+		}
+
+		// initialize sequence if necessary
+		seq := ipsByName.Sequence()
+		if seq == 0 {
+			// initialize sequence to MinIP
+			return ipsByName.SetSequence(uint64(internal.MinIP - 1)) // we subtract 1 so that the next call to NextSequence returns MinIP
+		}
+
+		return nil
+	})
+}
+
+// resetBuckets empties both buckets, retaining the current sequence
+func resetBuckets(tx *bolt.Tx) error {
+	seq := tx.Bucket(ipsByNameBucket).Sequence()
+	for _, name := range [][]byte{namesByIPBucket, ipsByNameBucket} {
+		if err := tx.DeleteBucket(name); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucket(name); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket(ipsByNameBucket).SetSequence(seq)
+}
+
+// load reads all mappings and the sequence from the database into the given memStore, evicting the least recently
+// used mappings if there are more than the memStore allows.
+//
+// Every mapping is stored in both buckets with the same timestamp, so that both directions always expire and get
+// deleted together. Databases written by older versions may contain records that violate this, for example names
+// pointing at IPs whose reverse record is gone. load repairs these by reconstructing mappings from the records of both
+// buckets, with fresher records taking precedence, and marking every record that doesn't match the result as dirty so
+// that the next commit rewrites or deletes it. Expired records are dropped the same way. Malformed records are deleted
+// immediately, including ones that can't be decrypted.
+func load(db *bolt.DB, mem *memStore, s *sealer) error {
+	type record struct {
+		ip    uint32
+		name  string
+		fresh time.Time
+	}
+	var names []*record
+	var ips []*record
+	var malformedNames, malformedIPs [][]byte
+	err := db.View(func(tx *bolt.Tx) error {
+		ipsByName := tx.Bucket(ipsByNameBucket)
+		mem.next = uint32(ipsByName.Sequence() + 1)
+		if mem.next > internal.MaxIP {
+			mem.next = internal.MinIP
+		}
+		err := ipsByName.ForEach(func(k, v []byte) error {
+			name, ip, fresh, ok := parseNameRecord(s, k, v)
+			if !ok {
+				malformedNames = append(malformedNames, copySlice(k))
+				return nil
+			}
+			names = append(names, &record{ip: ip, name: name, fresh: fresh})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(namesByIPBucket).ForEach(func(k, v []byte) error {
+			name, ip, fresh, ok := parseIPRecord(s, k, v)
+			if !ok {
+				malformedIPs = append(malformedIPs, copySlice(k))
+				return nil
+			}
+			ips = append(ips, &record{ip: ip, name: name, fresh: fresh})
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(malformedNames) > 0 || len(malformedIPs) > 0 {
+		log.Errorf("Deleting %d malformed names and %d malformed IPs", len(malformedNames), len(malformedIPs))
+		err = db.Update(func(tx *bolt.Tx) error {
+			for _, k := range malformedNames {
+				if err := tx.Bucket(ipsByNameBucket).Delete(k); err != nil {
+					return err
+				}
+			}
+			for _, k := range malformedIPs {
+				if err := tx.Bucket(namesByIPBucket).Delete(k); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// put mappings from least to most recently used, which is cheapest and lets fresher records win
+	all := append(append(make([]*record, 0, len(names)+len(ips)), names...), ips...)
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].fresh.Before(all[j].fresh)
+	})
+	for _, r := range all {
+		if time.Since(r.fresh) <= mem.maxAge {
+			mem.mappings.Put(r.name, r.ip, r.fresh)
+		}
+	}
+
+	// mark every record that doesn't exactly match a mapping as dirty, as well as mappings missing either record
+	expired, inconsistent := 0, 0
+	matches := func(r *record, mapping *internal.Mapping, found bool) bool {
+		if found && mapping.Name == r.name && mapping.IP == r.ip && mapping.Fresh.Equal(r.fresh) {
+			return true
+		}
+		if time.Since(r.fresh) > mem.maxAge {
+			expired++
+		} else {
+			inconsistent++
+		}
+		return false
+	}
+	matchedNames := make(map[string]bool, len(names))
+	for _, r := range names {
+		mapping, found := mem.mappings.ByName(r.name)
+		if matches(r, mapping, found) {
+			matchedNames[r.name] = true
+		} else {
+			mem.dirtyNames[r.name] = true
+		}
+	}
+	matchedIPs := make(map[uint32]bool, len(ips))
+	for _, r := range ips {
+		mapping, found := mem.mappings.ByIP(r.ip)
+		if matches(r, mapping, found) {
+			matchedIPs[r.ip] = true
+		} else {
+			mem.dirtyIPs[r.ip] = true
+		}
+	}
+	mem.mappings.Range(func(mapping *internal.Mapping) bool {
+		if !matchedNames[mapping.Name] || !matchedIPs[mapping.IP] {
+			mem.markDirty(mapping)
+		}
+		return true
+	})
+	log.Debugf("Deleting %d expired records and repairing %d inconsistent records", expired, inconsistent)
+
+	mem.evictExcess()
+	return nil
+}
+
+// compact writes the given full batch to a fresh database at the given path, replacing the existing file. bolt never
+// shrinks its file on its own, so this is the only way to reclaim space left behind by deleted entries.
+func compact(path string, b *batch, s *sealer) error {
+	tmpPath := path + ".compact"
+	os.Remove(tmpPath)
+	tmp, err := bolt.Open(tmpPath, 0644, nil)
+	if err != nil {
+		return err
+	}
+	err = initBolt(tmp, s)
+	if err == nil {
+		err = write(tmp, b, s)
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// keyValue is a key and value to put into a bucket, or to delete from it if value is nil
+type keyValue struct {
+	key   []byte
+	value []byte
+}
+
+// writeSorted applies the given records to the given bucket in key order. bolt splits pages only when committing, so
+// inserting many keys in random order into the same page is quadratic, while inserting them in order is cheap.
+func writeSorted(bucket *bolt.Bucket, records []keyValue) error {
+	sort.Slice(records, func(i, j int) bool {
+		return bytes.Compare(records[i].key, records[j].key) < 0
+	})
+	for _, r := range records {
+		var err error
+		if r.value == nil {
+			err = bucket.Delete(r.key)
+		} else {
+			err = bucket.Put(r.key, r.value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write writes a batch of changes to the database in a single transaction
+func write(db *bolt.DB, b *batch, s *sealer) error {
+	names := make([]keyValue, 0, len(b.names))
+	for name, mapping := range b.names {
+		if mapping == nil {
+			names = append(names, keyValue{key: s.nameKey(name)})
+		} else {
+			key, value, err := nameRecord(s, mapping)
+			if err != nil {
+				return err
+			}
+			names = append(names, keyValue{key: key, value: value})
+		}
+	}
+	ips := make([]keyValue, 0, len(b.ips))
+	for ip, mapping := range b.ips {
+		if mapping == nil {
+			ips = append(ips, keyValue{key: internal.IntToIP(ip)})
+		} else {
+			key, value, err := ipRecord(s, mapping)
+			if err != nil {
+				return err
+			}
+			ips = append(ips, keyValue{key: key, value: value})
+		}
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		if b.reset {
+			if err := resetBuckets(tx); err != nil {
+				return err
+			}
+		}
+		ipsByName := tx.Bucket(ipsByNameBucket)
+		if err := writeSorted(ipsByName, names); err != nil {
+			return err
+		}
+		if err := writeSorted(tx.Bucket(namesByIPBucket), ips); err != nil {
+			return err
+		}
+		if b.next != 0 {
+			return ipsByName.SetSequence(uint64(b.next) - 1)
+		}
+		return nil
+	})
+}
+
+// boltStore is a store backed by a bbolt database
+type boltStore struct {
+	db     *bolt.DB
+	sealer *sealer
+}
+
+func openBolt(filename string, s *sealer) (*boltStore, error) {
+	db, err := bolt.Open(filename, 0644, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = initBolt(db, s)
+	if err == errNotEncrypted {
+		// replace the file rather than resetting the database, since bolt would keep the plaintext in its free pages
+		log.Errorf("Database isn't encrypted, replacing it with an encrypted one")
+		db.Close()
+		if err := os.Remove(filename); err != nil {
+			return nil, err
+		}
+		db, err = bolt.Open(filename, 0644, nil)
+		if err != nil {
+			return nil, err
+		}
+		err = initBolt(db, s)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db: db, sealer: s}, nil
+}
+
+func (s *boltStore) load(mem *memStore) error {
+	return load(s.db, mem, s.sealer)
+}
+
+func (s *boltStore) write(b *batch) error {
+	return write(s.db, b, s.sealer)
+}
+
+func (s *boltStore) compact(b *batch) error {
+	path := s.db.Path()
+	if err := s.db.Close(); err != nil {
+		return err
+	}
+	compactErr := compact(path, b, s.sealer)
+	db, err := bolt.Open(path, 0644, nil)
+	if err != nil {
+		// we're left without a usable database, which means that writes will fail and the cache degrades
+		log.Errorf("Unable to reopen database after compaction: %v", err)
+		return err
+	}
+	s.db = db
+	return compactErr
+}
+
+// shouldCompact indicates whether the database is at least compactMinSize bytes and more than compactMinFreeRatio of it
+// is free space
+func (s *boltStore) shouldCompact() bool {
+	size := s.size()
+	if size < compactMinSize {
+		return false
+	}
+	// besides free pages, the file contains space that bolt preallocated beyond the highest page in use
+	var used int64
+	s.db.View(func(tx *bolt.Tx) error {
+		used = tx.Size()
+		return nil
+	})
+	free := size - used + int64(s.db.Stats().FreePageN*s.db.Info().PageSize)
+	return float64(free)/float64(size) > compactMinFreeRatio
+}
+
+func (s *boltStore) size() int64 {
+	return fileSize(s.db.Path())
+}
+
+func (s *boltStore) close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,489 @@
+package persistentcache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/getlantern/dnsgrab/internal"
+)
+
+const (
+	logMagic          = "DNSGRABL"
+	encryptedLogMagic = "DNSGRABE"
+	logVersion        = 1
+
+	// logRecordHeaderLen is the length of the length and checksum that precede every record
+	logRecordHeaderLen = 8
+
+	// maxLogRecordLen guards against allocating huge buffers when reading corrupt lengths
+	maxLogRecordLen = 1024 * 1024 * 1024
+
+	logFlagReset = 1
+)
+
+var (
+	// the log is snapshotted once it's at least logSnapshotMinSize bytes and more than twice the size of its last
+	// snapshot
+	logSnapshotMinSize = int64(1024 * 1024)
+
+	errCorruptRecord = errors.New("corrupt log record")
+)
+
+// logStore is a store backed by an append-only log file. The file starts with a header identifying the format, its
+// version, the fake IP range and the allocation mode. It's followed by records, each consisting of the length and
+// CRC32 checksum of its payload followed by the payload, which holds one batch of changes. Because every batch is
+// written as a single record, a crash can at most leave a partially written record at the end of the log, which is
+// discarded on load along with anything after it.
+//
+// Encrypted logs use a different magic, include a key check after the version and encrypt every payload.
+//
+// The log is periodically replaced by a snapshot containing only a single record with all current mappings.
+type logStore struct {
+	path         string
+	file         *os.File
+	sealer       *sealer
+	len          int64
+	snapshotSize int64
+}
+
+// NewLog opens a PersistentCache backed by an append-only log at the given filename with the given MaxAge, the
+// DefaultFlushInterval and the DefaultSweepInterval. Unlike bbolt databases, logs don't require memory mapping the
+// file.
+func NewLog(filename string, maxAge time.Duration) (*PersistentCache, error) {
+	return NewLogWithOptions(filename, &Options{MaxAge: maxAge, FlushInterval: DefaultFlushInterval, SweepInterval: DefaultSweepInterval})
+}
+
+// NewLogWithOptions opens a PersistentCache backed by an append-only log at the given filename. nil opts are the same
+// as empty ones.
+func NewLogWithOptions(filename string, opts *Options) (*PersistentCache, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	s, err := newSealer(opts.Key)
+	if err != nil {
+		return nil, err
+	}
+	st, err := openLog(filename, s)
+	if err != nil {
+		return nil, err
+	}
+	return newCache(st, opts, true)
+}
+
+func openLog(filename string, sealer *sealer) (*logStore, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s := &logStore{path: filename, file: file, sealer: sealer}
+	if err := s.checkHeader(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func logHeader(s *sealer) []byte {
+	header := append([]byte(logMagic), logVersion)
+	if s != nil {
+		header = append([]byte(encryptedLogMagic), logVersion)
+		header = append(header, s.keyCheck...)
+	}
+	header = append(header, uint32Bytes(internal.MinIP)...)
+	header = append(header, uint32Bytes(internal.MaxIP)...)
+	header = append(header, byte(len(allocationMode)))
+	return append(header, allocationMode...)
+}
+
+// checkHeader makes sure that the file is a log that's usable by this package, starting a new log if the file is
+// empty, was only partially initialized or was written for a different fake IP range or allocation mode. A log that
+// isn't encrypted even though it should be is replaced by an encrypted one.
+func (s *logStore) checkHeader() error {
+	expected := logHeader(s.sealer)
+	actual := make([]byte, len(expected))
+	n, err := io.ReadFull(s.file, actual)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	actual = actual[:n]
+	encrypted := bytes.HasPrefix(actual, []byte(encryptedLogMagic))
+	keyCheckEnd := len(encryptedLogMagic) + 1 + keyCheckLen
+	switch {
+	case bytes.Equal(actual, expected):
+		return nil
+	case bytes.HasPrefix(expected, actual):
+		// new or partially initialized log
+	case !encrypted && !bytes.HasPrefix(actual, []byte(logMagic)):
+		return fmt.Errorf("%v is not a dnsgrab log", s.path)
+	case len(actual) > len(logMagic) && actual[len(logMagic)] > logVersion:
+		return fmt.Errorf("%w: log has version %d, but only up to %d is supported", ErrUnsupportedSchema, actual[len(logMagic)], logVersion)
+	case encrypted && (s.sealer == nil || len(actual) >= keyCheckEnd && s.sealer.checkKey(actual[len(encryptedLogMagic)+1:keyCheckEnd]) != nil):
+		return ErrWrongKey
+	case !encrypted && s.sealer != nil:
+		log.Errorf("Log isn't encrypted, replacing it with an encrypted one")
+	default:
+		log.Errorf("Log was written for a different fake IP range or allocation mode, resetting it")
+	}
+	return s.reset()
+}
+
+// reset truncates the log to just its header
+func (s *logStore) reset() error {
+	if err := s.file.Truncate(0); err != nil {
+		return err
+	}
+	header := logHeader(s.sealer)
+	if _, err := s.file.WriteAt(header, 0); err != nil {
+		return err
+	}
+	s.len = int64(len(header))
+	return s.file.Sync()
+}
+
+func (s *logStore) load(mem *memStore) error {
+	headerLen := int64(len(logHeader(s.sealer)))
+	if _, err := s.file.Seek(headerLen, io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReader(s.file)
+	mappings := newReplayedMappings()
+	next := internal.MinIP
+	offset := headerLen
+	for {
+		payload, err := readLogRecord(r)
+		if err == io.EOF {
+			break
+		}
+		var batch []byte
+		if err == nil {
+			batch, err = s.sealer.open(payload, nil)
+		}
+		if err == nil {
+			err = replay(batch, mappings, &next)
+		}
+		if err != nil {
+			log.Errorf("Discarding incomplete or corrupt log records at offset %d: %v", offset, err)
+			if err := s.file.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+		offset += int64(logRecordHeaderLen + len(payload))
+	}
+	s.len = offset
+
+	mem.next = next
+	all := make([]*internal.Mapping, 0, len(mappings.byName))
+	for _, mapping := range mappings.byName {
+		all = append(all, mapping)
+	}
+	// put mappings from least to most recently used, which is cheapest
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Fresh.Before(all[j].Fresh)
+	})
+	snapshotSize := headerLen + logRecordHeaderLen + int64(s.sealer.overhead()) + 5
+	for _, mapping := range all {
+		if mem.isExpired(mapping) {
+			// mark as dirty so that the deletion gets logged
+			mem.markDirty(mapping)
+			continue
+		}
+		mem.mappings.Put(mapping.Name, mapping.IP, mapping.Fresh)
+		snapshotSize += int64(13 + len(mapping.Name))
+	}
+	s.snapshotSize = snapshotSize
+	mem.evictExcess()
+	return nil
+}
+
+func readLogRecord(r *bufio.Reader) ([]byte, error) {
+	header := make([]byte, logRecordHeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header)
+	if length > maxLogRecordLen {
+		return nil, errCorruptRecord
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, errCorruptRecord
+	}
+	return payload, nil
+}
+
+// encodeBatch encodes a batch as a flags byte, the sequence (0 if unchanged), deleted names, deleted IPs and then all
+// mappings to put
+func encodeBatch(b *batch) []byte {
+	var deletedNames []string
+	var deletedIPs []uint32
+	puts := make(map[string]*internal.Mapping)
+	for name, mapping := range b.names {
+		if mapping == nil {
+			deletedNames = append(deletedNames, name)
+		} else {
+			puts[name] = mapping
+		}
+	}
+	for ip, mapping := range b.ips {
+		if mapping == nil {
+			deletedIPs = append(deletedIPs, ip)
+		} else {
+			puts[mapping.Name] = mapping
+		}
+	}
+
+	var buf bytes.Buffer
+	var flags byte
+	if b.reset {
+		flags |= logFlagReset
+	}
+	buf.WriteByte(flags)
+	buf.Write(uint32Bytes(b.next))
+	writeUvarint(&buf, uint64(len(deletedNames)))
+	for _, name := range deletedNames {
+		writeString(&buf, name)
+	}
+	writeUvarint(&buf, uint64(len(deletedIPs)))
+	for _, ip := range deletedIPs {
+		buf.Write(uint32Bytes(ip))
+	}
+	writeUvarint(&buf, uint64(len(puts)))
+	for _, mapping := range puts {
+		buf.Write(uint32Bytes(mapping.IP))
+		var fresh [8]byte
+		binary.BigEndian.PutUint64(fresh[:], uint64(mapping.Fresh.UnixNano()))
+		buf.Write(fresh[:])
+		writeString(&buf, mapping.Name)
+	}
+	return buf.Bytes()
+}
+
+func writeUvarint(buf *bytes.Buffer, i uint64) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutUvarint(b[:], i)])
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	writeUvarint(buf, uint64(len(s)))
+	buf.WriteString(s)
+}
+
+// replayedMappings holds the mappings read from the log. Unlike internal.Mappings, it doesn't keep them ordered, since
+// records are replayed in no particular order and inserting them into an ordered list one by one is quadratic.
+type replayedMappings struct {
+	byName map[string]*internal.Mapping
+	byIP   map[uint32]*internal.Mapping
+}
+
+func newReplayedMappings() *replayedMappings {
+	m := &replayedMappings{}
+	m.reset()
+	return m
+}
+
+// put maps the given name to the given IP, dropping any existing mappings for either of them
+func (m *replayedMappings) put(name string, ip uint32, fresh time.Time) {
+	if existing, found := m.byName[name]; found {
+		m.remove(existing)
+	}
+	if existing, found := m.byIP[ip]; found {
+		m.remove(existing)
+	}
+	mapping := &internal.Mapping{Name: name, IP: ip, Fresh: fresh}
+	m.byName[name] = mapping
+	m.byIP[ip] = mapping
+}
+
+func (m *replayedMappings) remove(mapping *internal.Mapping) {
+	delete(m.byName, mapping.Name)
+	delete(m.byIP, mapping.IP)
+}
+
+func (m *replayedMappings) reset() {
+	m.byName = make(map[string]*internal.Mapping)
+	m.byIP = make(map[uint32]*internal.Mapping)
+}
+
+// replay applies an encoded batch to the given mappings and sequence
+func replay(payload []byte, mappings *replayedMappings, next *uint32) error {
+	r := bytes.NewReader(payload)
+	flags, err := r.ReadByte()
+	if err != nil {
+		return errCorruptRecord
+	}
+	if flags&logFlagReset != 0 {
+		mappings.reset()
+	}
+	var seq uint32
+	if err := binary.Read(r, binary.BigEndian, &seq); err != nil {
+		return errCorruptRecord
+	}
+	if seq != 0 {
+		*next = seq
+	}
+
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return errCorruptRecord
+	}
+	for i := uint64(0); i < count; i++ {
+		name, err := readString(r)
+		if err != nil {
+			return err
+		}
+		if mapping, found := mappings.byName[name]; found {
+			mappings.remove(mapping)
+		}
+	}
+
+	count, err = binary.ReadUvarint(r)
+	if err != nil {
+		return errCorruptRecord
+	}
+	for i := uint64(0); i < count; i++ {
+		var ip uint32
+		if err := binary.Read(r, binary.BigEndian, &ip); err != nil {
+			return errCorruptRecord
+		}
+		if mapping, found := mappings.byIP[ip]; found {
+			mappings.remove(mapping)
+		}
+	}
+
+	count, err = binary.ReadUvarint(r)
+	if err != nil {
+		return errCorruptRecord
+	}
+	for i := uint64(0); i < count; i++ {
+		var ip uint32
+		var fresh int64
+		if err := binary.Read(r, binary.BigEndian, &ip); err != nil {
+			return errCorruptRecord
+		}
+		if err := binary.Read(r, binary.BigEndian, &fresh); err != nil {
+			return errCorruptRecord
+		}
+		name, err := readString(r)
+		if err != nil {
+			return err
+		}
+		mappings.put(name, ip, time.Unix(0, fresh))
+	}
+
+	if r.Len() > 0 {
+		return errCorruptRecord
+	}
+	return nil
+}
+
+func readString(r *bytes.Reader) (string, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil || length > uint64(r.Len()) {
+		return "", errCorruptRecord
+	}
+	b := make([]byte, length)
+	r.Read(b)
+	return string(b), nil
+}
+
+func logRecord(payload []byte) []byte {
+	record := make([]byte, logRecordHeaderLen+len(payload))
+	binary.BigEndian.PutUint32(record, uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:], crc32.ChecksumIEEE(payload))
+	copy(record[logRecordHeaderLen:], payload)
+	return record
+}
+
+func (s *logStore) write(b *batch) error {
+	payload, err := s.sealer.seal(encodeBatch(b), nil)
+	if err != nil {
+		return err
+	}
+	record := logRecord(payload)
+	_, err = s.file.WriteAt(record, s.len)
+	if err == nil {
+		err = s.file.Sync()
+	}
+	if err != nil {
+		// drop whatever part of the record made it to disk so that later records don't end up behind it. If this fails
+		// too, the partial record is discarded along with everything after it the next time the log is loaded.
+		s.file.Truncate(s.len)
+		return err
+	}
+	s.len += int64(len(record))
+	return nil
+}
+
+// compact writes a snapshot to a new file and replaces the log with it
+func (s *logStore) compact(b *batch) error {
+	b.reset = true
+	payload, err := s.sealer.seal(encodeBatch(b), nil)
+	if err != nil {
+		return err
+	}
+	snapshot := append(logHeader(s.sealer), logRecord(payload)...)
+
+	tmpPath := s.path + ".compact"
+	err = writeFileSynced(tmpPath, snapshot)
+	if err == nil {
+		err = os.Rename(tmpPath, s.path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	s.file.Close()
+	file, err := os.OpenFile(s.path, os.O_RDWR, 0644)
+	if err != nil {
+		// we're left without a usable log, which means that writes will fail and the cache degrades
+		log.Errorf("Unable to reopen log after snapshotting: %v", err)
+		return err
+	}
+	s.file = file
+	s.len = int64(len(snapshot))
+	s.snapshotSize = s.len
+	return nil
+}
+
+func writeFileSynced(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (s *logStore) shouldCompact() bool {
+	return s.len >= logSnapshotMinSize && s.len > 2*s.snapshotSize
+}
+
+func (s *logStore) size() int64 {
+	return s.len
+}
+
+func (s *logStore) close() error {
+	return s.file.Close()
+}
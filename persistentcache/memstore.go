@@ -0,0 +1,256 @@
+package persistentcache
+
+import (
+	"time"
+
+	"github.com/getlantern/dnsgrab/internal"
+)
+
+// memStore holds all of the cache's mappings in memory and keeps track of which of them changed since they were last
+// written to disk. It is not safe for concurrent use.
+type memStore struct {
+	mappings   *internal.Mappings
+	next       uint32
+	maxAge     time.Duration
+	maxEntries int
+	expired    func(name string, ip []byte)
+	evicted    func(name string, ip []byte)
+
+	// dirty tracking
+	reset      bool
+	dirtyNames map[string]bool
+	dirtyIPs   map[uint32]bool
+	dirtySeq   bool
+}
+
+// batch is a set of changes to write to disk. nil values in names and ips mean that the corresponding key should be
+// deleted.
+type batch struct {
+	reset bool
+	next  uint32
+	names map[string]*internal.Mapping
+	ips   map[uint32]*internal.Mapping
+}
+
+func (b *batch) empty() bool {
+	return !b.reset && len(b.names) == 0 && len(b.ips) == 0 && b.next == 0
+}
+
+func newMemStore(maxAge time.Duration, maxEntries int, expired, evicted func(name string, ip []byte)) *memStore {
+	return &memStore{
+		mappings:   internal.NewMappings(),
+		next:       internal.MinIP,
+		maxAge:     maxAge,
+		maxEntries: maxEntries,
+		expired:    expired,
+		evicted:    evicted,
+		dirtyNames: make(map[string]bool),
+		dirtyIPs:   make(map[uint32]bool),
+	}
+}
+
+func (s *memStore) markDirty(mapping *internal.Mapping) {
+	s.dirtyNames[mapping.Name] = true
+	s.dirtyIPs[mapping.IP] = true
+}
+
+// checkExpired removes the given mapping if it's expired, returning true if it was removed
+func (s *memStore) checkExpired(mapping *internal.Mapping) bool {
+	if !s.isExpired(mapping) {
+		return false
+	}
+	log.Debugf("%v exceeds max age of %v", time.Since(mapping.Fresh), s.maxAge)
+	s.expire(mapping)
+	return true
+}
+
+func (s *memStore) isExpired(mapping *internal.Mapping) bool {
+	return time.Since(mapping.Fresh) > s.maxAge
+}
+
+func (s *memStore) expire(mapping *internal.Mapping) {
+	s.delete(mapping)
+	s.expired(mapping.Name, internal.IntToIP(mapping.IP))
+}
+
+// sweep removes up to max expired mappings, returning how many it removed. Since mappings are ordered by freshness,
+// expired mappings are always the least recently used ones.
+func (s *memStore) sweep(max int) int {
+	swept := 0
+	for swept < max {
+		oldest, found := s.mappings.Oldest()
+		if !found || !s.isExpired(oldest) {
+			break
+		}
+		s.expire(oldest)
+		swept++
+	}
+	return swept
+}
+
+func (s *memStore) delete(mapping *internal.Mapping) {
+	s.mappings.Remove(mapping)
+	s.markDirty(mapping)
+}
+
+func (s *memStore) nameByIP(ip []byte) (string, bool) {
+	mapping, found := s.mappings.ByIP(internal.IPToInt(ip))
+	if !found || s.checkExpired(mapping) {
+		return "", false
+	}
+	return mapping.Name, true
+}
+
+func (s *memStore) ipByName(name string) ([]byte, bool) {
+	mapping, found := s.mappings.ByName(name)
+	if !found || s.checkExpired(mapping) {
+		return nil, false
+	}
+	return internal.IntToIP(mapping.IP), true
+}
+
+func (s *memStore) restore(name string, ip []byte, fresh time.Time) {
+	ipInt := internal.IPToInt(ip)
+	// mark any mappings that are about to be displaced as dirty so that they get deleted from disk
+	if existing, found := s.mappings.ByName(name); found {
+		s.markDirty(existing)
+	}
+	if existing, found := s.mappings.ByIP(ipInt); found {
+		s.markDirty(existing)
+	}
+	s.markDirty(s.mappings.Put(name, ipInt, fresh))
+	s.evictExcess()
+}
+
+// evictExcess evicts least recently used mappings until the store is within its max entries
+func (s *memStore) evictExcess() {
+	if s.maxEntries <= 0 {
+		return
+	}
+	for s.mappings.Len() > s.maxEntries {
+		oldest, _ := s.mappings.Oldest()
+		s.delete(oldest)
+		s.evicted(oldest.Name, internal.IntToIP(oldest.IP))
+	}
+}
+
+func (s *memStore) markFresh(name string) {
+	if mapping, found := s.mappings.ByName(name); found {
+		s.mappings.Touch(mapping)
+		s.markDirty(mapping)
+	}
+}
+
+func (s *memStore) remove(name string) ([]byte, bool) {
+	mapping, found := s.mappings.ByName(name)
+	if !found {
+		return nil, false
+	}
+	s.delete(mapping)
+	return internal.IntToIP(mapping.IP), true
+}
+
+func (s *memStore) removeIP(ip []byte) (string, bool) {
+	mapping, found := s.mappings.ByIP(internal.IPToInt(ip))
+	if !found {
+		return "", false
+	}
+	s.delete(mapping)
+	return mapping.Name, true
+}
+
+func (s *memStore) flush() {
+	s.mappings.Reset()
+	// everything on disk is going away, so there's no point in tracking individual changes
+	s.reset = true
+	s.dirtyNames = make(map[string]bool)
+	s.dirtyIPs = make(map[uint32]bool)
+}
+
+func (s *memStore) rangeEntries(fn func(name string, ip []byte, fresh time.Time) bool) {
+	s.mappings.Range(func(mapping *internal.Mapping) bool {
+		if s.isExpired(mapping) {
+			return true
+		}
+		return fn(mapping.Name, internal.IntToIP(mapping.IP), mapping.Fresh)
+	})
+}
+
+func (s *memStore) nextSequence() uint32 {
+	next := s.next
+	s.next++
+	if s.next > internal.MaxIP {
+		// wrap IP to stay within allowed range
+		s.next = internal.MinIP
+	}
+	s.dirtySeq = true
+	return next
+}
+
+func (s *memStore) setSequence(next uint32) {
+	s.next = next
+	s.dirtySeq = true
+}
+
+// fullBatch returns a batch containing all mappings and the sequence, regardless of whether they changed
+func (s *memStore) fullBatch() *batch {
+	b := &batch{
+		next:  s.next,
+		names: make(map[string]*internal.Mapping, s.mappings.Len()),
+		ips:   make(map[uint32]*internal.Mapping, s.mappings.Len()),
+	}
+	s.mappings.Range(func(mapping *internal.Mapping) bool {
+		_mapping := *mapping
+		b.names[mapping.Name] = &_mapping
+		b.ips[mapping.IP] = &_mapping
+		return true
+	})
+	return b
+}
+
+// takeBatch returns the changes made since the last call to takeBatch and stops tracking them
+func (s *memStore) takeBatch() *batch {
+	b := &batch{
+		reset: s.reset,
+		names: make(map[string]*internal.Mapping, len(s.dirtyNames)),
+		ips:   make(map[uint32]*internal.Mapping, len(s.dirtyIPs)),
+	}
+	if s.dirtySeq {
+		b.next = s.next
+	}
+	for name := range s.dirtyNames {
+		var value *internal.Mapping
+		if mapping, found := s.mappings.ByName(name); found {
+			// copy since the mapping's freshness may change while the batch is being written
+			_mapping := *mapping
+			value = &_mapping
+		}
+		b.names[name] = value
+	}
+	for ip := range s.dirtyIPs {
+		var value *internal.Mapping
+		if mapping, found := s.mappings.ByIP(ip); found {
+			_mapping := *mapping
+			value = &_mapping
+		}
+		b.ips[ip] = value
+	}
+	s.reset = false
+	s.dirtySeq = false
+	s.dirtyNames = make(map[string]bool)
+	s.dirtyIPs = make(map[uint32]bool)
+	return b
+}
+
+// requeue starts tracking the changes in a batch that couldn't be written again, so that they're included in the next
+// batch
+func (s *memStore) requeue(b *batch) {
+	s.reset = s.reset || b.reset
+	s.dirtySeq = s.dirtySeq || b.next != 0
+	for name := range b.names {
+		s.dirtyNames[name] = true
+	}
+	for ip := range b.ips {
+		s.dirtyIPs[ip] = true
+	}
+}
@@ -1,249 +1,448 @@
 package persistentcache
 
 import (
-	"os"
+	"sync"
 	"time"
 
-	bolt "go.etcd.io/bbolt"
-
-	"github.com/getlantern/dnsgrab/internal"
 	"github.com/getlantern/golog"
 )
 
+const (
+	// DefaultFlushInterval is the default durability window of a PersistentCache
+	DefaultFlushInterval = 1 * time.Second
+
+	// DefaultSweepInterval is the default interval at which a PersistentCache removes expired entries
+	DefaultSweepInterval = 1 * time.Minute
+
+	// DefaultSweepBatchSize is the default maximum number of expired entries removed while holding the cache's lock
+	DefaultSweepBatchSize = 1000
+)
+
 var (
 	log = golog.LoggerFor("dnsgrab.persistentcache")
 
-	namesByIPBucket = []byte("namesByIP")
-	ipsByNameBucket = []byte("ipsByName")
+	// the database is compacted on open if it's at least compactMinSize bytes and more than compactMinFreeRatio of it
+	// is free space
+	compactMinSize      = int64(1024 * 1024)
+	compactMinFreeRatio = 0.5
 )
 
-type entry []byte
-
-func newEntry(value []byte) []byte {
-	e := make(entry, 8+len(value))
-	copy(e[8:], value)
-	e.mark()
-	return e
+// Options configures a PersistentCache
+type Options struct {
+	// MaxAge is how long entries remain in the cache after they were last marked fresh
+	MaxAge time.Duration
+
+	// FlushInterval is the durability window, meaning how often changes are written to disk in a single batched
+	// transaction. Changes made within the window are lost if the process dies without closing the cache. If zero or
+	// negative, every change is written to disk immediately.
+	FlushInterval time.Duration
+
+	// MaxEntries limits the number of entries in the cache, evicting the least recently used entries once it's
+	// exceeded. If zero or negative, the number of entries is bounded only by MaxAge.
+	MaxEntries int
+
+	// SweepInterval is how often expired entries are removed in the background. Expired entries are also removed
+	// whenever they're looked up. If zero or negative, expired entries are only removed on lookup and at startup.
+	SweepInterval time.Duration
+
+	// SweepBatchSize limits how many expired entries are removed at once, so that sweeping doesn't block lookups for
+	// long. If zero or negative, DefaultSweepBatchSize is used.
+	SweepBatchSize int
+
+	// Key enables encryption at rest. Mappings are encrypted with a key derived from it and names are only stored as
+	// keyed hashes outside of encrypted values, so that no names appear in the file in plaintext. Must be at least 16
+	// bytes long and kept secret. Opening an encrypted cache with a different key or without a key fails with
+	// ErrWrongKey, while an existing cache that isn't encrypted is discarded and replaced by an encrypted one.
+	Key []byte
 }
 
-// We have to copy any byte arrays returned by bolt since those are only valid during the lifetime of a transaction.
-// See https://pkg.go.dev/go.etcd.io/bbolt/#Bucket.Get
-func (e entry) copy() entry {
-	e2 := make(entry, len(e))
-	copy(e2, e)
-	return e2
+// PersistentCache is an age bounded on-disk cache, stored either in a bbolt database (see New) or in an append-only log
+// (see NewLog).
+//
+// All entries are held in memory, from which lookups are served. Changes are written to disk in periodic batches,
+// with multiple changes to the same entry coalesced into a single write. If the database becomes unusable (for
+// example because the disk is full or the filesystem became read-only), the cache keeps working from memory and keeps
+// retrying to write pending changes. Changes that were applied in memory don't fail just because they couldn't be
+// written yet; whether writes are failing can be checked with Degraded, and Sync returns the error of a failed write.
+type PersistentCache struct {
+	store store
+	mem   *memStore
+	opts  Options
+
+	// compactAfterWrites indicates that the store should be compacted whenever it's grown enough, rather than only
+	// when opening it
+	compactAfterWrites bool
+
+	onExpired  []func(name string, ip []byte)
+	onEvicted  []func(name string, ip []byte)
+	handlersMx sync.RWMutex
+	degraded   bool
+	mx         sync.Mutex
+	commitMx   sync.Mutex
+	stop       chan interface{}
+	workers    sync.WaitGroup
+	closeOnce  sync.Once
 }
 
-func (e entry) mark() {
-	now := uint64(time.Now().UnixNano())
-	internal.Endianness.PutUint64(e, now)
+// New opens a PersistentCache at the given filename with the given MaxAge, the DefaultFlushInterval and the
+// DefaultSweepInterval
+func New(filename string, maxAge time.Duration) (*PersistentCache, error) {
+	return NewWithOptions(filename, &Options{MaxAge: maxAge, FlushInterval: DefaultFlushInterval, SweepInterval: DefaultSweepInterval})
 }
 
-func (e entry) expired(maxAge time.Duration) bool {
-	elapsed := time.Duration(time.Now().UnixNano()) - e.tsNanos()
-	expired := elapsed > maxAge
-	if expired {
-		log.Debugf("%v exceeds max age of %v", elapsed, maxAge)
+// NewWithOptions opens a PersistentCache at the given filename. nil opts are the same as empty ones.
+func NewWithOptions(filename string, opts *Options) (*PersistentCache, error) {
+	if opts == nil {
+		opts = &Options{}
 	}
-	return expired
+	s, err := newSealer(opts.Key)
+	if err != nil {
+		return nil, err
+	}
+	st, err := openBolt(filename, s)
+	if err != nil {
+		return nil, err
+	}
+	return newCache(st, opts, false)
 }
 
-func (e entry) tsNanos() time.Duration {
-	return time.Duration(internal.Endianness.Uint64(e))
+func newCache(st store, opts *Options, compactAfterWrites bool) (*PersistentCache, error) {
+	cache := &PersistentCache{
+		store:              st,
+		opts:               *opts,
+		compactAfterWrites: compactAfterWrites,
+		stop:               make(chan interface{}),
+	}
+	if cache.opts.SweepBatchSize <= 0 {
+		cache.opts.SweepBatchSize = DefaultSweepBatchSize
+	}
+	cache.mem = newMemStore(opts.MaxAge, opts.MaxEntries, cache.expired, cache.evicted)
+	if err := st.load(cache.mem); err != nil {
+		st.close()
+		return nil, err
+	}
+	// write deletions of expired records and repairs of inconsistent ones right away
+	if err := cache.commit(); err != nil {
+		st.close()
+		return nil, err
+	}
+
+	if st.shouldCompact() {
+		// compacting a large database takes a while, so don't hold up opening it
+		cache.workers.Add(1)
+		go func() {
+			defer cache.workers.Done()
+			if err := cache.Compact(); err != nil {
+				log.Errorf("Unable to compact database: %v", err)
+			}
+		}()
+	}
+
+	if opts.FlushInterval > 0 {
+		cache.workers.Add(1)
+		go cache.commitPeriodically()
+	}
+	if opts.SweepInterval > 0 {
+		cache.workers.Add(1)
+		go cache.sweepPeriodically()
+	}
+	return cache, nil
 }
 
-func (e entry) value() []byte {
-	// We have to copy any byte arrays returned by bolt since those are only valid during the lifetime of a transaction.
-	// See https://pkg.go.dev/go.etcd.io/bbolt/#Bucket.Get
-	return copySlice(e[8:])
+// Close writes any pending changes to disk and closes the persistent cache. Closing an already closed cache is a
+// no-op.
+func (cache *PersistentCache) Close() (err error) {
+	cache.closeOnce.Do(func() {
+		close(cache.stop)
+		cache.workers.Wait()
+		if commitErr := cache.commit(); commitErr != nil {
+			log.Errorf("Unable to write pending changes on close, they will be lost: %v", commitErr)
+			err = commitErr
+		}
+		if closeErr := cache.store.close(); err == nil {
+			err = closeErr
+		}
+	})
+	return
 }
 
-func copySlice(b []byte) []byte {
-	result := make([]byte, len(b))
-	copy(result, b)
-	return result
+// Sync immediately writes any pending changes to disk
+func (cache *PersistentCache) Sync() error {
+	return cache.commit()
 }
 
-// PersistentCache is an age bounded on-disk cache
-type PersistentCache struct {
-	db *bolt.DB
+// Degraded indicates whether the last attempt to write changes to disk failed, in which case the cache keeps
+// working from memory until it manages to write them. Call Sync to find out why writing fails.
+func (cache *PersistentCache) Degraded() bool {
+	cache.mx.Lock()
+	defer cache.mx.Unlock()
+	return cache.degraded
+}
 
-	maxAge time.Duration
+// Compact writes all pending changes to disk and rewrites the database file from scratch, reclaiming space left behind
+// by deleted entries. The cache stays usable while compacting, but changes made in the meantime are only written to
+// disk afterwards. Databases are also compacted in the background when opening them if that reclaims a lot of space.
+func (cache *PersistentCache) Compact() error {
+	cache.commitMx.Lock()
+	defer cache.commitMx.Unlock()
+	return cache.compact()
 }
 
-func New(filename string, maxAge time.Duration) (*PersistentCache, error) {
-	db, err := bolt.Open(filename, 0644, nil)
+// compact compacts the store. The caller must hold commitMx, but not mx.
+func (cache *PersistentCache) compact() error {
+	cache.mx.Lock()
+	// the compacted store contains everything, so nothing that's pending now needs to be written separately
+	pending := cache.mem.takeBatch()
+	full := cache.mem.fullBatch()
+	cache.mx.Unlock()
+
+	sizeBefore := cache.store.size()
+	err := cache.store.compact(full)
+
+	cache.mx.Lock()
+	defer cache.mx.Unlock()
 	if err != nil {
-		return nil, err
+		cache.mem.requeue(pending)
+		return err
 	}
+	cache.degraded = false
+	log.Debugf("Compacted database from %d to %d bytes", sizeBefore, cache.store.size())
+	return nil
+}
 
-	err = db.Update(func(tx *bolt.Tx) error {
-		// create buckets if necessary
-		namesByIP, err := tx.CreateBucketIfNotExists(namesByIPBucket)
-		if err != nil {
-			return err
-		}
-
-		ipsByName, err := tx.CreateBucketIfNotExists(ipsByNameBucket)
-		if err != nil {
-			return err
-		}
+// ThreadSafe indicates that PersistentCache is safe for concurrent use
+func (cache *PersistentCache) ThreadSafe() bool {
+	return true
+}
 
-		// delete expired entries
-		namesDeleted := 0
-		ipsDeleted := 0
+// OnEvicted registers a function that gets called whenever an entry is evicted to stay within MaxEntries. Functions
+// registered earlier keep getting called.
+func (cache *PersistentCache) OnEvicted(fn func(name string, ip []byte)) {
+	cache.handlersMx.Lock()
+	cache.onEvicted = append(cache.onEvicted, fn)
+	cache.handlersMx.Unlock()
+}
 
-		err = namesByIP.ForEach(func(k, v []byte) error {
-			if entry(v).expired(maxAge) {
-				namesDeleted++
-				return namesByIP.Delete(k)
-			}
-			return nil
-		})
-		if err != nil {
-			return err
-		}
+// OnExpired registers a function that gets called whenever an expired entry is removed from the cache. Functions
+// registered earlier keep getting called.
+func (cache *PersistentCache) OnExpired(fn func(name string, ip []byte)) {
+	cache.handlersMx.Lock()
+	cache.onExpired = append(cache.onExpired, fn)
+	cache.handlersMx.Unlock()
+}
 
-		err = ipsByName.ForEach(func(k, v []byte) error {
-			if entry(v).expired(maxAge) {
-				ipsDeleted++
-				return ipsByName.Delete(k)
-			}
-			return nil
-		})
-		if err != nil {
-			return err
-		}
+func (cache *PersistentCache) NameByIP(ip []byte) (name string, found bool, err error) {
+	cache.do(func(mem *memStore) {
+		name, found = mem.nameByIP(ip)
+	})
+	return
+}
 
-		log.Debugf("Deleted %d names and %d ips", namesDeleted, ipsDeleted)
+func (cache *PersistentCache) IPByName(name string) (ip []byte, found bool, err error) {
+	cache.do(func(mem *memStore) {
+		ip, found = mem.ipByName(name)
+	})
+	return
+}
 
-		// initialize sequence if necessary
-		seq := ipsByName.Sequence()
-		if seq == 0 {
-			// initialize sequence to MinIP
-			ipsByName.SetSequence(uint64(internal.MinIP - 1)) // we subtract 1 so that the next call to NextSequence returns MinIP
-		}
+func (cache *PersistentCache) Add(name string, ip []byte) error {
+	return cache.Restore(name, ip, time.Now())
+}
 
-		return nil
+// Restore adds a mapping that was last marked fresh at the given time
+func (cache *PersistentCache) Restore(name string, ip []byte, fresh time.Time) error {
+	cache.do(func(mem *memStore) {
+		mem.restore(name, ip, fresh)
 	})
-	if err != nil {
-		return nil, err
-	}
-
-	return &PersistentCache{
-		db:     db,
-		maxAge: maxAge,
-	}, nil
+	return nil
 }
 
-// Close closes the persistent cache
-func (cache *PersistentCache) Close() error {
-	return cache.db.Close()
+func (cache *PersistentCache) MarkFresh(name string, ip []byte) error {
+	cache.do(func(mem *memStore) {
+		mem.markFresh(name)
+	})
+	return nil
 }
 
-func (cache *PersistentCache) NameByIP(ip []byte) (name string, found bool) {
-	cache.update(func(namesByIP *bolt.Bucket, ipsByName *bolt.Bucket) error {
-		e := entry(namesByIP.Get(ip))
-		if e == nil {
-			return nil
-		}
+// Remove removes the mapping for the given name
+func (cache *PersistentCache) Remove(name string) (ip []byte, found bool, err error) {
+	cache.do(func(mem *memStore) {
+		ip, found = mem.remove(name)
+	})
+	return
+}
 
-		_name := e.value()
-		if !e.expired(cache.maxAge) {
-			name = string(_name)
-			found = true
-		} else {
-			namesByIP.Delete(ip)
-			ipsByName.Delete(_name)
-			name, found = "", false
-		}
-		return nil
+// RemoveIP removes the mapping for the given IP
+func (cache *PersistentCache) RemoveIP(ip []byte) (name string, found bool, err error) {
+	cache.do(func(mem *memStore) {
+		name, found = mem.removeIP(ip)
 	})
 	return
 }
 
-func (cache *PersistentCache) IPByName(name string) (ip []byte, found bool) {
-	cache.update(func(namesByIP *bolt.Bucket, ipsByName *bolt.Bucket) error {
-		_name := []byte(name)
-		e := entry(ipsByName.Get(_name))
-		if e == nil {
-			return nil
-		}
+// Flush removes all mappings from the cache. The sequence is left as is so that recently handed out IPs aren't
+// immediately reused.
+func (cache *PersistentCache) Flush() error {
+	cache.do(func(mem *memStore) {
+		mem.flush()
+	})
+	return nil
+}
 
-		ip = e.value()
-		if !e.expired(cache.maxAge) {
-			found = true
-		} else {
-			if err := ipsByName.Delete(_name); err != nil {
-				return nil
-			}
-			if err := namesByIP.Delete(ip); err != nil {
-				return nil
-			}
-			ip, found = nil, false
-		}
-		return nil
+// Range calls fn for every unexpired entry in the cache, in no particular order, until fn returns false. The cache is
+// locked while ranging, so entries represent a consistent snapshot of the cache.
+func (cache *PersistentCache) Range(fn func(name string, ip []byte, fresh time.Time) bool) error {
+	cache.mx.Lock()
+	defer cache.mx.Unlock()
+	cache.mem.rangeEntries(fn)
+	return nil
+}
+
+func (cache *PersistentCache) NextSequence() (next uint32, err error) {
+	cache.do(func(mem *memStore) {
+		next = mem.nextSequence()
 	})
 	return
 }
 
-func (cache *PersistentCache) Add(name string, ip []byte) {
-	cache.update(func(namesByIP *bolt.Bucket, ipsByName *bolt.Bucket) error {
-		nameBytes := []byte(name)
-		err := namesByIP.Put(ip, newEntry(nameBytes))
-		if err != nil {
-			return err
-		}
-		return ipsByName.Put(nameBytes, newEntry(ip))
+// Sequence returns the value that the next call to NextSequence will return
+func (cache *PersistentCache) Sequence() (uint32, error) {
+	cache.mx.Lock()
+	defer cache.mx.Unlock()
+	return cache.mem.next, nil
+}
+
+// SetSequence sets the value that the next call to NextSequence will return
+func (cache *PersistentCache) SetSequence(next uint32) error {
+	cache.do(func(mem *memStore) {
+		mem.setSequence(next)
 	})
+	return nil
 }
 
-func (cache *PersistentCache) MarkFresh(name string, ip []byte) {
-	cache.update(func(namesByIP *bolt.Bucket, ipsByName *bolt.Bucket) error {
-		_name := []byte(name)
-		nameEntry := entry(namesByIP.Get(ip)).copy()
-		ipEntry := entry(ipsByName.Get(_name)).copy()
-		nameEntry.mark()
-		ipEntry.mark()
-		if err := namesByIP.Put(ip, nameEntry); err != nil {
-			return err
+// do runs fn against the in-memory store and, if the cache doesn't have a durability window, immediately writes the
+// resulting changes to disk
+func (cache *PersistentCache) do(fn func(mem *memStore)) {
+	cache.mx.Lock()
+	fn(cache.mem)
+	cache.mx.Unlock()
+
+	if cache.opts.FlushInterval <= 0 {
+		if err := cache.commit(); err != nil {
+			log.Errorf("Unable to write changes to disk, will retry: %v", err)
 		}
-		return ipsByName.Put(_name, ipEntry)
-	})
+	}
 }
 
-func (cache *PersistentCache) NextSequence() (next uint32) {
-	err := cache.db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(ipsByNameBucket)
-		_next, err := bucket.NextSequence()
-		if err != nil {
-			return err
+func (cache *PersistentCache) commitPeriodically() {
+	defer cache.workers.Done()
+
+	ticker := time.NewTicker(cache.opts.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-cache.stop:
+			return
+		case <-ticker.C:
+			if err := cache.commit(); err != nil {
+				log.Errorf("Unable to write changes to disk, will retry: %v", err)
+			}
 		}
-		if _next > uint64(internal.MaxIP) {
-			err = bucket.SetSequence(uint64(internal.MinIP))
-			if err != nil {
-				return err
+	}
+}
+
+func (cache *PersistentCache) sweepPeriodically() {
+	defer cache.workers.Done()
+
+	ticker := time.NewTicker(cache.opts.SweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-cache.stop:
+			return
+		case <-ticker.C:
+			if swept := cache.sweep(); swept > 0 {
+				log.Debugf("Swept %d expired entries", swept)
 			}
-			_next = uint64(internal.MinIP)
 		}
-		next = uint32(_next)
+	}
+}
+
+// sweep removes all expired entries in batches of at most SweepBatchSize, releasing the lock in between so that
+// lookups can proceed. The removals are written to disk with the next commit. It stops early if the cache is closed.
+func (cache *PersistentCache) sweep() int {
+	total := 0
+	for {
+		var swept int
+		cache.do(func(mem *memStore) {
+			swept = mem.sweep(cache.opts.SweepBatchSize)
+		})
+		total += swept
+		if swept < cache.opts.SweepBatchSize {
+			return total
+		}
+		select {
+		case <-cache.stop:
+			return total
+		default:
+		}
+	}
+}
+
+// commit writes all pending changes to disk in a single transaction. If that fails, the changes remain pending.
+func (cache *PersistentCache) commit() error {
+	// serialize commits so that an older batch can't overwrite a newer one
+	cache.commitMx.Lock()
+	defer cache.commitMx.Unlock()
+
+	cache.mx.Lock()
+	b := cache.mem.takeBatch()
+	cache.mx.Unlock()
+	if b.empty() {
 		return nil
-	})
+	}
+
+	err := cache.store.write(b)
+
+	cache.mx.Lock()
 	if err != nil {
-		// This should never happen and likely means the db is corrupt. Delete the database and then panic.
-		os.RemoveAll(cache.db.Path())
-		panic(err)
+		if !cache.degraded {
+			log.Errorf("Database unusable, keeping changes in memory until they can be written: %v", err)
+		}
+		cache.degraded = true
+		cache.mem.requeue(b)
+		cache.mx.Unlock()
+		return err
 	}
-	return
+	if cache.degraded {
+		log.Debug("Database usable again, wrote pending changes")
+	}
+	cache.degraded = false
+	cache.mx.Unlock()
+	if cache.compactAfterWrites && cache.store.shouldCompact() {
+		if err := cache.compact(); err != nil {
+			log.Errorf("Unable to compact database: %v", err)
+		}
+	}
+	return nil
 }
 
-func (cache *PersistentCache) update(fn func(namesByIP *bolt.Bucket, ipsByName *bolt.Bucket) error) {
-	err := cache.db.Update(func(tx *bolt.Tx) error {
-		namesByIP := tx.Bucket(namesByIPBucket)
-		ipsByName := tx.Bucket(ipsByNameBucket)
-		return fn(namesByIP, ipsByName)
-	})
-	if err != nil {
-		panic(err)
+func (cache *PersistentCache) expired(name string, ip []byte) {
+	cache.handlersMx.RLock()
+	handlers := cache.onExpired
+	cache.handlersMx.RUnlock()
+	for _, handler := range handlers {
+		handler(name, ip)
+	}
+}
+
+func (cache *PersistentCache) evicted(name string, ip []byte) {
+	cache.handlersMx.RLock()
+	handlers := cache.onEvicted
+	cache.handlersMx.RUnlock()
+	for _, handler := range handlers {
+		handler(name, ip)
 	}
 }
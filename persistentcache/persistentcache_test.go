@@ -0,0 +1,731 @@
+package persistentcache
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/getlantern/dnsgrab/internal"
+)
+
+type opener func(filename string, opts *Options) (*PersistentCache, error)
+
+// forEachBackend runs the given test against each of the backends
+func forEachBackend(t *testing.T, test func(t *testing.T, open opener)) {
+	for name, open := range map[string]opener{"bolt": NewWithOptions, "log": NewLogWithOptions} {
+		open := open
+		t.Run(name, func(t *testing.T) {
+			test(t, open)
+		})
+	}
+}
+
+func TestBatching(t *testing.T) {
+	forEachBackend(t, testBatching)
+}
+
+func testBatching(t *testing.T, open opener) {
+	tmpDir, err := ioutil.TempDir("", "persistentcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	filename := filepath.Join(tmpDir, "dnsgrab.db")
+	// use a durability window that's long enough to never elapse during the test
+	cache, err := open(filename, &Options{MaxAge: time.Minute, FlushInterval: time.Hour})
+	require.NoError(t, err)
+
+	for i := uint32(0); i < 10; i++ {
+		next, err := cache.NextSequence()
+		require.NoError(t, err)
+		require.NoError(t, cache.Add("domain", internal.IntToIP(next)))
+		require.NoError(t, cache.MarkFresh("domain", internal.IntToIP(next)))
+	}
+	_, _, err = cache.Remove("domain")
+	require.NoError(t, err)
+	next, _ := cache.NextSequence()
+	require.NoError(t, cache.Add("last", internal.IntToIP(next)))
+	require.NoError(t, cache.Close(), "close should write pending changes")
+	require.NoError(t, cache.Close(), "closing twice should be fine")
+
+	reopened, err := open(filename, &Options{MaxAge: time.Minute})
+	require.NoError(t, err)
+	defer reopened.Close()
+
+	_, found, err := reopened.IPByName("domain")
+	require.NoError(t, err)
+	require.False(t, found, "removed name shouldn't be persisted")
+	for i := uint32(0); i < 10; i++ {
+		_, found, err := reopened.NameByIP(internal.IntToIP(internal.MinIP + i))
+		require.NoError(t, err)
+		require.False(t, found, "IPs displaced by remapping name shouldn't be persisted")
+	}
+	ip, found, err := reopened.IPByName("last")
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, internal.MinIP+10, internal.IPToInt(ip))
+	next, err = reopened.NextSequence()
+	require.NoError(t, err)
+	require.Equal(t, internal.MinIP+11, next, "sequence should be persisted")
+}
+
+func TestNilOptions(t *testing.T) {
+	forEachBackend(t, testNilOptions)
+}
+
+func testNilOptions(t *testing.T, open opener) {
+	tmpDir, err := ioutil.TempDir("", "persistentcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	cache, err := open(filepath.Join(tmpDir, "dnsgrab.db"), nil)
+	require.NoError(t, err, "nil options should be the same as empty ones")
+	require.NoError(t, cache.Close())
+}
+
+func TestDegradedMode(t *testing.T) {
+	forEachBackend(t, testDegradedMode)
+}
+
+// setReadOnly simulates the filesystem becoming read-only or writable again
+func setReadOnly(t *testing.T, cache *PersistentCache, readOnly bool) {
+	switch st := cache.store.(type) {
+	case *boltStore:
+		path := st.db.Path()
+		require.NoError(t, st.db.Close())
+		db, err := bolt.Open(path, 0644, &bolt.Options{ReadOnly: readOnly})
+		require.NoError(t, err)
+		st.db = db
+	case *logStore:
+		require.NoError(t, st.file.Close())
+		flag := os.O_RDWR
+		if readOnly {
+			flag = os.O_RDONLY
+		}
+		file, err := os.OpenFile(st.path, flag, 0644)
+		require.NoError(t, err)
+		st.file = file
+	}
+}
+
+func testDegradedMode(t *testing.T, open opener) {
+	tmpDir, err := ioutil.TempDir("", "persistentcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	filename := filepath.Join(tmpDir, "dnsgrab.db")
+	cache, err := open(filename, &Options{MaxAge: time.Minute, FlushInterval: time.Hour})
+	require.NoError(t, err)
+
+	ip1 := internal.IntToIP(internal.MinIP)
+	require.NoError(t, cache.Add("domain1", ip1))
+	require.NoError(t, cache.Sync())
+	require.False(t, cache.Degraded())
+
+	setReadOnly(t, cache, true)
+
+	ip2 := internal.IntToIP(internal.MinIP + 1)
+	require.NoError(t, cache.Add("domain2", ip2))
+	require.Error(t, cache.Sync())
+	require.True(t, cache.Degraded())
+
+	name, found, err := cache.NameByIP(ip2)
+	require.NoError(t, err)
+	require.True(t, found, "degraded cache should keep working from memory")
+	require.Equal(t, "domain2", name)
+	require.NoError(t, cache.MarkFresh("domain2", ip2), "changes should keep being applied in memory")
+	require.True(t, cache.Degraded())
+
+	// make the database writable again and let the cache recover
+	setReadOnly(t, cache, false)
+	require.NoError(t, cache.Sync())
+	require.False(t, cache.Degraded(), "cache should recover once database is usable")
+	require.NoError(t, cache.Close())
+
+	reopened, err := open(filename, &Options{MaxAge: time.Minute})
+	require.NoError(t, err)
+	defer reopened.Close()
+	for _, name := range []string{"domain1", "domain2"} {
+		_, found, err = reopened.IPByName(name)
+		require.NoError(t, err)
+		require.True(t, found, "%v should be persisted after recovery", name)
+	}
+}
+
+// failingStore is a store that can't write anything
+type failingStore struct {
+	err error
+}
+
+func (st *failingStore) load(mem *memStore) error { return nil }
+func (st *failingStore) write(b *batch) error     { return st.err }
+func (st *failingStore) compact(b *batch) error   { return st.err }
+func (st *failingStore) shouldCompact() bool      { return false }
+func (st *failingStore) size() int64              { return 0 }
+func (st *failingStore) close() error             { return nil }
+
+func TestWriteErrors(t *testing.T) {
+	errDiskFull := errors.New("disk full")
+	cache, err := newCache(&failingStore{err: errDiskFull}, &Options{MaxAge: time.Minute}, false)
+	require.NoError(t, err)
+	ip := internal.IntToIP(internal.MinIP)
+	require.NoError(t, cache.Add("domain1", ip), "changes that were applied in memory shouldn't fail")
+	require.True(t, cache.Degraded(), "without a durability window, failed writes should degrade the cache immediately")
+	_, found, err := cache.IPByName("domain1")
+	require.NoError(t, err)
+	require.True(t, found, "failed change should be kept in memory")
+	require.ErrorIs(t, cache.Sync(), errDiskFull)
+	require.ErrorIs(t, cache.Close(), errDiskFull)
+
+	cache, err = newCache(&failingStore{err: errDiskFull}, &Options{MaxAge: time.Minute, FlushInterval: 10 * time.Millisecond}, false)
+	require.NoError(t, err)
+	defer cache.Close()
+	require.NoError(t, cache.Add("domain1", ip))
+	require.Eventually(t, cache.Degraded, 5*time.Second, 10*time.Millisecond)
+	next, err := cache.NextSequence()
+	require.NoError(t, err, "failed background writes shouldn't fail unrelated changes")
+	require.Equal(t, internal.MinIP, next)
+	require.ErrorIs(t, cache.Sync(), errDiskFull)
+	_, found, err = cache.IPByName("domain1")
+	require.NoError(t, err, "lookups should keep working from memory")
+	require.True(t, found)
+}
+
+func TestMaxEntries(t *testing.T) {
+	forEachBackend(t, testMaxEntries)
+}
+
+func testMaxEntries(t *testing.T, open opener) {
+	tmpDir, err := ioutil.TempDir("", "persistentcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	filename := filepath.Join(tmpDir, "dnsgrab.db")
+	cache, err := open(filename, &Options{MaxAge: time.Minute, FlushInterval: time.Hour, MaxEntries: 2})
+	require.NoError(t, err)
+
+	var evicted, evictedAgain []string
+	cache.OnEvicted(func(name string, ip []byte) {
+		evicted = append(evicted, name)
+	})
+	cache.OnEvicted(func(name string, ip []byte) {
+		evictedAgain = append(evictedAgain, name)
+	})
+
+	for i, name := range []string{"domain1", "domain2", "domain3"} {
+		if name == "domain3" {
+			// refresh domain1 so that domain2 becomes the least recently used
+			require.NoError(t, cache.MarkFresh("domain1", internal.IntToIP(internal.MinIP)))
+		}
+		require.NoError(t, cache.Add(name, internal.IntToIP(internal.MinIP+uint32(i))))
+	}
+	require.Equal(t, []string{"domain2"}, evicted)
+	require.Equal(t, evicted, evictedAgain, "all registered functions should be called")
+	require.NoError(t, cache.Close())
+
+	// reopen with a smaller limit
+	reopened, err := open(filename, &Options{MaxAge: time.Minute, FlushInterval: time.Hour, MaxEntries: 1})
+	require.NoError(t, err)
+	defer reopened.Close()
+	var names []string
+	require.NoError(t, reopened.Range(func(name string, ip []byte, fresh time.Time) bool {
+		names = append(names, name)
+		return true
+	}))
+	require.Equal(t, []string{"domain3"}, names, "least recently used entries should be evicted on open")
+}
+
+func TestCompaction(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "persistentcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	filename := filepath.Join(tmpDir, "dnsgrab.db")
+	cache, err := NewWithOptions(filename, &Options{MaxAge: time.Minute, FlushInterval: time.Hour})
+	require.NoError(t, err)
+
+	const numEntries = 20000
+	for i := 0; i < numEntries; i++ {
+		require.NoError(t, cache.Add(fmt.Sprintf("%080d.com", i), internal.IntToIP(internal.MinIP+uint32(i))))
+	}
+	require.NoError(t, cache.Sync())
+	for i := 10; i < numEntries; i++ {
+		_, _, err := cache.Remove(fmt.Sprintf("%080d.com", i))
+		require.NoError(t, err)
+	}
+	require.NoError(t, cache.Close())
+	sizeBefore := fileSize(filename)
+	require.True(t, sizeBefore > compactMinSize, "test should produce a database large enough to be compacted")
+
+	reopened, err := New(filename, time.Minute)
+	require.NoError(t, err)
+	defer reopened.Close()
+	require.Eventually(t, func() bool {
+		return fileSize(filename) < sizeBefore/2
+	}, 5*time.Second, 10*time.Millisecond, "database should be compacted in the background after opening")
+
+	var count int
+	require.NoError(t, reopened.Range(func(name string, ip []byte, fresh time.Time) bool {
+		count++
+		return true
+	}))
+	require.Equal(t, 10, count, "compaction should retain remaining entries")
+	_, err = reopened.NextSequence()
+	require.NoError(t, err)
+	require.NoError(t, reopened.Compact(), "explicit compaction should work too")
+	ip, found, err := reopened.IPByName(fmt.Sprintf("%080d.com", 5))
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, internal.MinIP+5, internal.IPToInt(ip))
+}
+
+func TestSweep(t *testing.T) {
+	forEachBackend(t, testSweep)
+}
+
+func testSweep(t *testing.T, open opener) {
+	tmpDir, err := ioutil.TempDir("", "persistentcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	filename := filepath.Join(tmpDir, "dnsgrab.db")
+	maxAge := 1 * time.Second
+	cache, err := open(filename, &Options{
+		MaxAge:         maxAge,
+		FlushInterval:  10 * time.Millisecond,
+		SweepInterval:  10 * time.Millisecond,
+		SweepBatchSize: 2,
+	})
+	require.NoError(t, err)
+
+	var mx sync.Mutex
+	var expired []string
+	cache.OnExpired(func(name string, ip []byte) {
+		mx.Lock()
+		expired = append(expired, name)
+		mx.Unlock()
+	})
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, cache.Add(fmt.Sprintf("domain%d", i), internal.IntToIP(internal.MinIP+uint32(i))))
+	}
+	time.Sleep(maxAge / 2)
+	require.NoError(t, cache.Add("fresh", internal.IntToIP(internal.MinIP+5)))
+
+	require.Eventually(t, func() bool {
+		mx.Lock()
+		defer mx.Unlock()
+		return len(expired) == 5
+	}, 5*time.Second, 10*time.Millisecond, "sweeper should remove all expired entries without them being looked up")
+	require.NoError(t, cache.Close())
+
+	// reopen with a max age long enough for swept entries to show up again if they hadn't been deleted on disk
+	reopened, err := open(filename, &Options{MaxAge: time.Hour})
+	require.NoError(t, err)
+	defer reopened.Close()
+	var names []string
+	require.NoError(t, reopened.Range(func(name string, ip []byte, fresh time.Time) bool {
+		names = append(names, name)
+		return true
+	}))
+	require.Equal(t, []string{"fresh"}, names, "only the fresh entry should remain on disk")
+}
+
+func TestRepair(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "persistentcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	filename := filepath.Join(tmpDir, "dnsgrab.db")
+	db, err := bolt.Open(filename, 0644, nil)
+	require.NoError(t, err)
+	require.NoError(t, initBolt(db, nil))
+
+	now := time.Now()
+	stale := now.Add(-2 * time.Minute)
+	ip := func(i uint32) []byte { return internal.IntToIP(internal.MinIP + i) }
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		namesByIP := tx.Bucket(namesByIPBucket)
+		ipsByName := tx.Bucket(ipsByNameBucket)
+		// consistent pair
+		namesByIP.Put(ip(0), newEntry([]byte("consistent"), now))
+		ipsByName.Put([]byte("consistent"), newEntry(ip(0), now))
+		// pair with diverging timestamps, one of which is expired
+		namesByIP.Put(ip(1), newEntry([]byte("diverging"), stale))
+		ipsByName.Put([]byte("diverging"), newEntry(ip(1), now))
+		// name whose reverse record is gone
+		ipsByName.Put([]byte("orphanedname"), newEntry(ip(2), now))
+		// IP whose forward record is gone
+		namesByIP.Put(ip(3), newEntry([]byte("orphanedip"), now))
+		// name pointing at an IP that was since reassigned to a fresher name
+		ipsByName.Put([]byte("displaced"), newEntry(ip(4), now.Add(-time.Second)))
+		namesByIP.Put(ip(4), newEntry([]byte("reassigned"), now))
+		ipsByName.Put([]byte("reassigned"), newEntry(ip(4), now))
+		// expired pair
+		namesByIP.Put(ip(5), newEntry([]byte("expired"), stale))
+		ipsByName.Put([]byte("expired"), newEntry(ip(5), stale))
+		// malformed records
+		namesByIP.Put([]byte("bad"), newEntry([]byte("malformed"), now))
+		ipsByName.Put([]byte("malformed"), []byte("bad"))
+		return nil
+	}))
+	require.NoError(t, db.Close())
+
+	cache, err := New(filename, time.Minute)
+	require.NoError(t, err)
+	require.NoError(t, cache.Close())
+
+	expected := map[string]uint32{
+		"consistent":   0,
+		"diverging":    1,
+		"orphanedname": 2,
+		"orphanedip":   3,
+		"reassigned":   4,
+	}
+	db, err = bolt.Open(filename, 0644, nil)
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		namesByIP := tx.Bucket(namesByIPBucket)
+		ipsByName := tx.Bucket(ipsByNameBucket)
+		require.Equal(t, len(expected), namesByIP.Stats().KeyN)
+		require.Equal(t, len(expected), ipsByName.Stats().KeyN)
+		for name, i := range expected {
+			forward := entry(ipsByName.Get([]byte(name)))
+			require.NotEmpty(t, forward, name)
+			require.Equal(t, ip(i), forward.value(), name)
+			reverse := entry(namesByIP.Get(ip(i)))
+			require.NotEmpty(t, reverse, name)
+			require.Equal(t, name, string(reverse.value()))
+			require.Equal(t, forward.fresh(), reverse.fresh(), "both directions of %v should share a timestamp", name)
+		}
+		return nil
+	}))
+}
+
+func TestSchemaMigration(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "persistentcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	filename := filepath.Join(tmpDir, "dnsgrab.db")
+	ip := internal.IntToIP(internal.MinIP)
+	updateDB := func(fn func(tx *bolt.Tx) error) {
+		db, err := bolt.Open(filename, 0644, nil)
+		require.NoError(t, err)
+		require.NoError(t, db.Update(fn))
+		require.NoError(t, db.Close())
+	}
+	requireFound := func(expected bool) {
+		cache, err := New(filename, time.Minute)
+		require.NoError(t, err)
+		defer cache.Close()
+		_, found, err := cache.IPByName("domain")
+		require.NoError(t, err)
+		require.Equal(t, expected, found)
+	}
+
+	// database written before schema versioning
+	updateDB(func(tx *bolt.Tx) error {
+		namesByIP, _ := tx.CreateBucket(namesByIPBucket)
+		ipsByName, _ := tx.CreateBucket(ipsByNameBucket)
+		ipsByName.SetSequence(uint64(internal.MinIP))
+		namesByIP.Put(ip, newEntry([]byte("domain"), time.Now()))
+		return ipsByName.Put([]byte("domain"), newEntry(ip, time.Now()))
+	})
+	requireFound(true)
+	updateDB(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(metaBucket)
+		require.NotNil(t, meta, "meta bucket should be added")
+		require.Equal(t, uint32Bytes(schemaVersion), meta.Get(versionKey))
+		require.Equal(t, uint32Bytes(internal.MinIP), meta.Get(minIPKey))
+		require.Equal(t, uint32Bytes(internal.MaxIP), meta.Get(maxIPKey))
+		require.Equal(t, allocationMode, string(meta.Get(allocationKey)))
+
+		// pretend that the database was written by a future version
+		return meta.Put(versionKey, uint32Bytes(schemaVersion+1))
+	})
+	_, err = New(filename, time.Minute)
+	require.True(t, errors.Is(err, ErrUnsupportedSchema), "newer schema should be rejected, got %v", err)
+
+	// pretend that the database was written for a different fake IP range
+	updateDB(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(metaBucket)
+		meta.Put(versionKey, uint32Bytes(schemaVersion))
+		return meta.Put(minIPKey, uint32Bytes(internal.MinIP+100))
+	})
+	requireFound(false)
+	cache, err := New(filename, time.Minute)
+	require.NoError(t, err)
+	defer cache.Close()
+	next, err := cache.NextSequence()
+	require.NoError(t, err)
+	require.Equal(t, internal.MinIP, next, "sequence should be reset along with mappings")
+	require.NoError(t, cache.Add("domain", ip))
+	require.NoError(t, cache.Close())
+
+	// pretend that there's no migration from the database's version
+	oldMigrations := migrations
+	migrations = nil
+	defer func() {
+		migrations = oldMigrations
+	}()
+	updateDB(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucket).Put(versionKey, uint32Bytes(0))
+	})
+	requireFound(false)
+	updateDB(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(metaBucket)
+		require.NotNil(t, meta, "meta bucket should be recreated after resetting")
+		require.Equal(t, uint32Bytes(schemaVersion), meta.Get(versionKey))
+		require.Equal(t, uint32Bytes(internal.MinIP), meta.Get(minIPKey))
+		return nil
+	})
+}
+
+func TestLogSnapshot(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "persistentcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	oldMinSize := logSnapshotMinSize
+	logSnapshotMinSize = 4096
+	defer func() {
+		logSnapshotMinSize = oldMinSize
+	}()
+
+	filename := filepath.Join(tmpDir, "dnsgrab.log")
+	cache, err := NewLogWithOptions(filename, &Options{MaxAge: time.Minute})
+	require.NoError(t, err)
+
+	// keep refreshing a small set of entries, which grows the log without growing its contents
+	for i := 0; i < 1000; i++ {
+		name := fmt.Sprintf("domain%d", i%10)
+		require.NoError(t, cache.Add(name, internal.IntToIP(internal.MinIP+uint32(i%10))))
+		require.True(t, fileSize(filename) < 2*logSnapshotMinSize, "log should be snapshotted as it grows")
+	}
+	require.NoError(t, cache.Close())
+
+	reopened, err := NewLog(filename, time.Minute)
+	require.NoError(t, err)
+	defer reopened.Close()
+	for i := uint32(0); i < 10; i++ {
+		ip, found, err := reopened.IPByName(fmt.Sprintf("domain%d", i))
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, internal.MinIP+i, internal.IPToInt(ip))
+	}
+}
+
+func TestLogRecovery(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "persistentcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	filename := filepath.Join(tmpDir, "dnsgrab.log")
+	cache, err := NewLogWithOptions(filename, &Options{MaxAge: time.Minute})
+	require.NoError(t, err)
+	require.NoError(t, cache.Add("domain1", internal.IntToIP(internal.MinIP)))
+	sizeAfterFirst := fileSize(filename)
+	require.NoError(t, cache.Add("domain2", internal.IntToIP(internal.MinIP+1)))
+	require.NoError(t, cache.Close())
+
+	reopen := func() *PersistentCache {
+		cache, err := NewLog(filename, time.Minute)
+		require.NoError(t, err)
+		return cache
+	}
+	requireFound := func(cache *PersistentCache, name string, expected bool) {
+		_, found, err := cache.IPByName(name)
+		require.NoError(t, err)
+		require.Equal(t, expected, found, name)
+	}
+
+	// simulate a crash in the middle of writing the last record
+	require.NoError(t, os.Truncate(filename, fileSize(filename)-3))
+	cache = reopen()
+	requireFound(cache, "domain1", true)
+	requireFound(cache, "domain2", false)
+	require.Equal(t, sizeAfterFirst, fileSize(filename), "incomplete record should be discarded")
+	require.NoError(t, cache.Add("domain3", internal.IntToIP(internal.MinIP+2)))
+	require.NoError(t, cache.Close())
+
+	// corrupt the last record
+	data, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	data[len(data)-1] ^= 0xFF
+	require.NoError(t, ioutil.WriteFile(filename, data, 0644))
+	cache = reopen()
+	requireFound(cache, "domain1", true)
+	requireFound(cache, "domain3", false)
+	require.NoError(t, cache.Close())
+
+	// files that aren't logs are left alone
+	notALog := filepath.Join(tmpDir, "notalog")
+	require.NoError(t, ioutil.WriteFile(notALog, []byte("something else entirely"), 0644))
+	_, err = NewLog(notALog, time.Minute)
+	require.Error(t, err)
+
+	// logs written by future versions are rejected
+	header := logHeader(nil)
+	header[len(logMagic)]++
+	require.NoError(t, ioutil.WriteFile(filename, header, 0644))
+	_, err = NewLog(filename, time.Minute)
+	require.True(t, errors.Is(err, ErrUnsupportedSchema), "newer version should be rejected, got %v", err)
+}
+
+func TestEncryption(t *testing.T) {
+	forEachBackend(t, testEncryption)
+}
+
+func testEncryption(t *testing.T, open opener) {
+	tmpDir, err := ioutil.TempDir("", "persistentcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	filename := filepath.Join(tmpDir, "dnsgrab.db")
+	key := []byte("0123456789abcdef0123456789abcdef")
+	requireNotOnDisk := func(name string) {
+		b, err := ioutil.ReadFile(filename)
+		require.NoError(t, err)
+		require.NotContains(t, string(b), name, "name shouldn't be stored in plaintext")
+	}
+
+	// a plaintext cache is replaced when opening it with a key
+	cache, err := open(filename, &Options{MaxAge: time.Minute})
+	require.NoError(t, err)
+	require.NoError(t, cache.Add("plain.example.com", internal.IntToIP(internal.MinIP)))
+	require.NoError(t, cache.Close())
+	cache, err = open(filename, &Options{MaxAge: time.Minute, Key: key})
+	require.NoError(t, err)
+	_, found, err := cache.IPByName("plain.example.com")
+	require.NoError(t, err)
+	require.False(t, found, "plaintext entries should have been discarded")
+	requireNotOnDisk("plain.example.com")
+
+	require.NoError(t, cache.Add("secret.example.com", internal.IntToIP(internal.MinIP+1)))
+	require.NoError(t, cache.Close())
+	requireNotOnDisk("secret.example.com")
+
+	_, err = open(filename, &Options{MaxAge: time.Minute})
+	require.ErrorIs(t, err, ErrWrongKey, "opening without key should fail")
+	_, err = open(filename, &Options{MaxAge: time.Minute, Key: []byte("fedcba9876543210fedcba9876543210")})
+	require.ErrorIs(t, err, ErrWrongKey, "opening with different key should fail")
+	_, err = open(filename, &Options{MaxAge: time.Minute, Key: []byte("short")})
+	require.Error(t, err, "short keys should be rejected")
+
+	cache, err = open(filename, &Options{MaxAge: time.Minute, Key: key})
+	require.NoError(t, err)
+	defer cache.Close()
+	ip, found, err := cache.IPByName("secret.example.com")
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, internal.MinIP+1, internal.IPToInt(ip))
+	name, found, err := cache.NameByIP(ip)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, "secret.example.com", name)
+}
+
+func TestSealedRecordsBoundToKeys(t *testing.T) {
+	s, err := newSealer([]byte("0123456789abcdef0123456789abcdef"))
+	require.NoError(t, err)
+	mapping1 := &internal.Mapping{Name: "domain1", IP: internal.MinIP, Fresh: time.Now()}
+	mapping2 := &internal.Mapping{Name: "domain2", IP: internal.MinIP + 1, Fresh: time.Now()}
+	k1, v1, err := ipRecord(s, mapping1)
+	require.NoError(t, err)
+	k2, v2, err := ipRecord(s, mapping2)
+	require.NoError(t, err)
+
+	name, _, _, ok := parseIPRecord(s, k1, v1)
+	require.True(t, ok)
+	require.Equal(t, "domain1", name)
+	_, _, _, ok = parseIPRecord(s, k1, v2)
+	require.False(t, ok, "value of another IP shouldn't be accepted")
+	_, _, _, ok = parseIPRecord(s, k2, v1)
+	require.False(t, ok, "value of another IP shouldn't be accepted")
+}
+
+// failingReader is a source of randomness that always fails
+type failingReader struct{}
+
+func (failingReader) Read(b []byte) (int, error) {
+	return 0, errors.New("no randomness available")
+}
+
+func TestNonceFailure(t *testing.T) {
+	forEachBackend(t, testNonceFailure)
+}
+
+func testNonceFailure(t *testing.T, open opener) {
+	tmpDir, err := ioutil.TempDir("", "persistentcache")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	cache, err := open(filepath.Join(tmpDir, "dnsgrab.db"), &Options{MaxAge: time.Minute, FlushInterval: time.Hour, Key: []byte("0123456789abcdef0123456789abcdef")})
+	require.NoError(t, err)
+	nonceSource = failingReader{}
+	defer func() {
+		nonceSource = rand.Reader
+	}()
+	require.NoError(t, cache.Add("domain1", internal.IntToIP(internal.MinIP)))
+	require.Error(t, cache.Sync(), "failing to generate a nonce should fail the write")
+	require.True(t, cache.Degraded(), "failing to generate a nonce should degrade the cache instead of crashing")
+	_, found, err := cache.IPByName("domain1")
+	require.NoError(t, err)
+	require.True(t, found)
+
+	nonceSource = rand.Reader
+	require.NoError(t, cache.Close(), "pending changes should be written once nonces can be generated again")
+}
+
+func BenchmarkCompact(b *testing.B) {
+	tmpDir, err := ioutil.TempDir("", "persistentcache")
+	require.NoError(b, err)
+	defer os.RemoveAll(tmpDir)
+
+	cache, err := NewWithOptions(filepath.Join(tmpDir, "dnsgrab.db"), &Options{MaxAge: time.Hour, FlushInterval: time.Hour})
+	require.NoError(b, err)
+	defer cache.Close()
+	for i := 0; i < 60000; i++ {
+		require.NoError(b, cache.Add(fmt.Sprintf("domain%d.com", i), internal.IntToIP(internal.MinIP+uint32(i))))
+	}
+	require.NoError(b, cache.Sync())
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		require.NoError(b, cache.Compact())
+	}
+}
+
+func BenchmarkLogReopen(b *testing.B) {
+	tmpDir, err := ioutil.TempDir("", "persistentcache")
+	require.NoError(b, err)
+	defer os.RemoveAll(tmpDir)
+
+	filename := filepath.Join(tmpDir, "dnsgrab.log")
+	cache, err := NewLogWithOptions(filename, &Options{MaxAge: time.Hour, FlushInterval: time.Hour})
+	require.NoError(b, err)
+	for i := 0; i < 60000; i++ {
+		require.NoError(b, cache.Add(fmt.Sprintf("domain%d.com", i), internal.IntToIP(internal.MinIP+uint32(i))))
+		if i%1000 == 0 {
+			require.NoError(b, cache.Sync())
+		}
+	}
+	require.NoError(b, cache.Close())
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		reopened, err := NewLogWithOptions(filename, &Options{MaxAge: time.Hour, FlushInterval: time.Hour})
+		require.NoError(b, err)
+		require.NoError(b, reopened.Close())
+	}
+}
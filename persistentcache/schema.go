@@ -0,0 +1,134 @@
+package persistentcache
+
+import (
+	"errors"
+	"fmt"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/getlantern/dnsgrab/internal"
+)
+
+const (
+	// schemaVersion is the version of the database layout written by this package
+	schemaVersion = 1
+
+	// allocationMode identifies how fake IPs are handed out. IPs are currently always allocated sequentially.
+	allocationMode = "sequential"
+)
+
+var (
+	// ErrUnsupportedSchema means that a database was written with a newer schema than this package supports
+	ErrUnsupportedSchema = errors.New("unsupported database schema")
+
+	metaBucket    = []byte("meta")
+	versionKey    = []byte("version")
+	minIPKey      = []byte("minIP")
+	maxIPKey      = []byte("maxIP")
+	allocationKey = []byte("allocation")
+	keyCheckKey   = []byte("keyCheck")
+
+	// migrations[v] upgrades a database from schema version v to v+1. Databases at a version without a migration are
+	// reset instead.
+	migrations = []func(tx *bolt.Tx) error{
+		// version 0 predates the meta bucket but otherwise has the same layout as version 1
+		func(tx *bolt.Tx) error { return nil },
+	}
+)
+
+// migrate brings the database up to the current schemaVersion and records the schema version, fake IP range, allocation
+// mode and, when encrypting, a key check in the meta bucket. Databases whose mappings aren't usable with the current
+// fake IP range or allocation mode are reset. Encrypted databases whose key check doesn't match fail with ErrWrongKey,
+// and existing databases that aren't encrypted even though s is set fail with errNotEncrypted.
+func migrate(tx *bolt.Tx, s *sealer) error {
+	meta := tx.Bucket(metaBucket)
+	version := uint32(0)
+	if meta != nil {
+		if v := meta.Get(versionKey); len(v) == 4 {
+			version = internal.Endianness.Uint32(v)
+		}
+	} else if tx.Bucket(namesByIPBucket) == nil && tx.Bucket(ipsByNameBucket) == nil {
+		// new database
+		version = schemaVersion
+	}
+
+	if version > schemaVersion {
+		return fmt.Errorf("%w: database has version %d, but only up to %d is supported", ErrUnsupportedSchema, version, schemaVersion)
+	}
+	var keyCheck []byte
+	if meta != nil {
+		keyCheck = meta.Get(keyCheckKey)
+	}
+	if keyCheck != nil {
+		if err := s.checkKey(keyCheck); err != nil {
+			return err
+		}
+	} else if s != nil && (meta != nil || tx.Bucket(namesByIPBucket) != nil || tx.Bucket(ipsByNameBucket) != nil) {
+		return errNotEncrypted
+	}
+	for ; version < schemaVersion; version++ {
+		if int(version) >= len(migrations) || migrations[version] == nil {
+			log.Errorf("Unable to migrate database from schema version %d, resetting it", version)
+			if err := resetDatabase(tx); err != nil {
+				return err
+			}
+			break
+		}
+		log.Debugf("Migrating database from schema version %d to %d", version, version+1)
+		if err := migrations[version](tx); err != nil {
+			return fmt.Errorf("unable to migrate database from schema version %d: %w", version, err)
+		}
+	}
+
+	// re-read the meta bucket, which is gone if the database was reset while migrating
+	meta = tx.Bucket(metaBucket)
+	if meta != nil {
+		minIP, maxIP, allocation := meta.Get(minIPKey), meta.Get(maxIPKey), meta.Get(allocationKey)
+		if len(minIP) != 4 || internal.Endianness.Uint32(minIP) != internal.MinIP ||
+			len(maxIP) != 4 || internal.Endianness.Uint32(maxIP) != internal.MaxIP ||
+			string(allocation) != allocationMode {
+			log.Errorf("Database was written for a different fake IP range or allocation mode, resetting it")
+			if err := resetDatabase(tx); err != nil {
+				return err
+			}
+		}
+	}
+
+	meta, err := tx.CreateBucketIfNotExists(metaBucket)
+	if err != nil {
+		return err
+	}
+	for k, v := range map[string][]byte{
+		string(versionKey):    uint32Bytes(schemaVersion),
+		string(minIPKey):      uint32Bytes(internal.MinIP),
+		string(maxIPKey):      uint32Bytes(internal.MaxIP),
+		string(allocationKey): []byte(allocationMode),
+	} {
+		if err := meta.Put([]byte(k), v); err != nil {
+			return err
+		}
+	}
+	if s != nil {
+		return meta.Put(keyCheckKey, s.keyCheck)
+	}
+	return nil
+}
+
+// resetDatabase deletes all mappings along with the sequence
+func resetDatabase(tx *bolt.Tx) error {
+	for _, name := range [][]byte{namesByIPBucket, ipsByNameBucket, metaBucket} {
+		if tx.Bucket(name) == nil {
+			continue
+		}
+		if err := tx.DeleteBucket(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func uint32Bytes(i uint32) []byte {
+	b := make([]byte, 4)
+	internal.Endianness.PutUint32(b, i)
+	return b
+}
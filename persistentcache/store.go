@@ -0,0 +1,32 @@
+package persistentcache
+
+import "os"
+
+// store is the on-disk representation of a PersistentCache's mappings
+type store interface {
+	// load reads all mappings and the sequence into the given memStore, marking anything that needs to be deleted or
+	// rewritten on disk as dirty
+	load(mem *memStore) error
+
+	// write durably writes a batch of changes. If it fails, none of the changes may be visible to the next load.
+	write(b *batch) error
+
+	// compact replaces everything on disk with the given full batch, as returned by memStore.fullBatch
+	compact(b *batch) error
+
+	// shouldCompact indicates whether compacting would reclaim a significant amount of space
+	shouldCompact() bool
+
+	// size returns the size of the store on disk in bytes
+	size() int64
+
+	close() error
+}
+
+func fileSize(path string) int64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
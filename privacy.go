@@ -0,0 +1,30 @@
+package dnsgrab
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"github.com/getlantern/dns"
+)
+
+// loggableName returns the given name as it may appear in log output, spans and query logs. In privacy mode, that's a
+// short keyed hash of the normalized name, so that entries about the same name can still be correlated.
+func (s *server) loggableName(name string) string {
+	if len(s.opts.PrivacyKey) == 0 || name == "" {
+		return name
+	}
+	mac := hmac.New(sha256.New, s.opts.PrivacyKey)
+	mac.Write([]byte(strings.ToLower(normalizeName(name))))
+	return "name-" + hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// loggableQuestions formats the given questions for log output
+func (s *server) loggableQuestions(questions ...dns.Question) string {
+	formatted := make([]string, 0, len(questions))
+	for _, question := range questions {
+		formatted = append(formatted, s.loggableName(question.Name)+" "+qtypeString(question.Qtype))
+	}
+	return "[" + strings.Join(formatted, ", ") + "]"
+}
@@ -0,0 +1,109 @@
+// Package prommetrics provides a dnsgrab.Metrics implementation that exports measurements to Prometheus.
+package prommetrics
+
+import (
+	"time"
+
+	"github.com/getlantern/dnsgrab"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type metrics struct {
+	questions      *prometheus.CounterVec
+	upstreamTime   *prometheus.HistogramVec
+	upstreamErrors *prometheus.CounterVec
+	cacheLookups   *prometheus.CounterVec
+	cacheEvents    *prometheus.CounterVec
+	cacheSize      prometheus.Gauge
+	sequence       prometheus.Gauge
+	sequenceWraps  prometheus.Counter
+}
+
+// New creates dnsgrab.Metrics that are registered with the given Registerer under the given namespace, for example
+// "dnsgrab".
+func New(reg prometheus.Registerer, namespace string) (dnsgrab.Metrics, error) {
+	m := &metrics{
+		questions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "questions_total",
+			Help:      "Number of questions handled, by type and outcome.",
+		}, []string{"type", "outcome"}),
+		upstreamTime: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "upstream_duration_seconds",
+			Help:      "Latency of exchanges with upstream DNS servers.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"server"}),
+		upstreamErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "upstream_errors_total",
+			Help:      "Number of failed exchanges with upstream DNS servers.",
+		}, []string{"server"}),
+		cacheLookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "cache_lookups_total",
+			Help:      "Number of lookups of fake IPs in the cache, by result.",
+		}, []string{"result"}),
+		cacheEvents: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "cache_events_total",
+			Help:      "Number of changes to the cache, by event.",
+		}, []string{"event"}),
+		cacheSize: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "cache_size",
+			Help:      "Number of entries in the cache.",
+		}),
+		sequence: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "sequence",
+			Help:      "Most recently allocated fake IP, as an integer.",
+		}),
+		sequenceWraps: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "sequence_wraps_total",
+			Help:      "Number of times the sequence wrapped around to the beginning of the fake IP range.",
+		}),
+	}
+	collectors := []prometheus.Collector{
+		m.questions, m.upstreamTime, m.upstreamErrors, m.cacheLookups, m.cacheEvents, m.cacheSize, m.sequence,
+		m.sequenceWraps,
+	}
+	for _, c := range collectors {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (m *metrics) QuestionHandled(qtype string, outcome dnsgrab.Outcome) {
+	m.questions.WithLabelValues(qtype, outcome.String()).Inc()
+}
+
+func (m *metrics) UpstreamExchanged(server string, latency time.Duration, err error) {
+	m.upstreamTime.WithLabelValues(server).Observe(latency.Seconds())
+	if err != nil {
+		m.upstreamErrors.WithLabelValues(server).Inc()
+	}
+}
+
+func (m *metrics) CacheLookedUp(hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	m.cacheLookups.WithLabelValues(result).Inc()
+}
+
+func (m *metrics) CacheChanged(event dnsgrab.EventType, size int) {
+	m.cacheEvents.WithLabelValues(event.String()).Inc()
+	m.cacheSize.Set(float64(size))
+}
+
+func (m *metrics) SequenceAdvanced(next uint32, wrapped bool) {
+	m.sequence.Set(float64(next))
+	if wrapped {
+		m.sequenceWraps.Inc()
+	}
+}
@@ -0,0 +1,46 @@
+package prommetrics
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/getlantern/dnsgrab"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m, err := New(reg, "dnsgrab")
+	require.NoError(t, err)
+
+	m.QuestionHandled("A", dnsgrab.OutcomeGrabbed)
+	m.QuestionHandled("A", dnsgrab.OutcomeGrabbed)
+	m.QuestionHandled("MX", dnsgrab.OutcomeForwarded)
+	m.UpstreamExchanged("8.8.8.8:53", 10*time.Millisecond, nil)
+	m.UpstreamExchanged("8.8.8.8:53", time.Second, errors.New("timeout"))
+	m.CacheLookedUp(true)
+	m.CacheLookedUp(false)
+	m.CacheChanged(dnsgrab.EventMapped, 1)
+	m.CacheChanged(dnsgrab.EventMapped, 2)
+	m.CacheChanged(dnsgrab.EventEvicted, 1)
+	m.SequenceAdvanced(5, false)
+	m.SequenceAdvanced(1, true)
+
+	mm := m.(*metrics)
+	require.EqualValues(t, 2, testutil.ToFloat64(mm.questions.WithLabelValues("A", "grabbed")))
+	require.EqualValues(t, 1, testutil.ToFloat64(mm.questions.WithLabelValues("MX", "forwarded")))
+	require.EqualValues(t, 1, testutil.ToFloat64(mm.upstreamErrors.WithLabelValues("8.8.8.8:53")))
+	require.EqualValues(t, 1, testutil.CollectAndCount(mm.upstreamTime))
+	require.EqualValues(t, 1, testutil.ToFloat64(mm.cacheLookups.WithLabelValues("hit")))
+	require.EqualValues(t, 1, testutil.ToFloat64(mm.cacheLookups.WithLabelValues("miss")))
+	require.EqualValues(t, 2, testutil.ToFloat64(mm.cacheEvents.WithLabelValues("mapped")))
+	require.EqualValues(t, 1, testutil.ToFloat64(mm.cacheSize))
+	require.EqualValues(t, 1, testutil.ToFloat64(mm.sequence))
+	require.EqualValues(t, 1, testutil.ToFloat64(mm.sequenceWraps))
+
+	_, err = New(reg, "dnsgrab")
+	require.Error(t, err, "registering twice should fail")
+}
@@ -0,0 +1,135 @@
+package dnsgrab
+
+import (
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/getlantern/dns"
+)
+
+// QueryLogger receives a QueryLogEntry for every query that a server processes, as configured with Options.QueryLog.
+// Implementations must be safe for concurrent use and return quickly, since they're called while processing queries.
+// See the separate github.com/getlantern/dnsgrab/querylog module for implementations that write JSON lines and dnstap.
+type QueryLogger interface {
+	LogQuery(entry *QueryLogEntry)
+}
+
+// QueryLogEntry describes a single query and how it was answered
+type QueryLogEntry struct {
+	// Time is when processing of the query started
+	Time time.Time
+
+	// Duration is how long it took to process the query
+	Duration time.Duration
+
+	// Client is the address of the client that sent the query, nil if unknown or redacted
+	Client net.Addr
+
+	// Protocol is the transport the query arrived over, "udp" or "tcp"
+	Protocol string
+
+	// Query is the query in wire format, nil if redacted or in privacy mode
+	Query []byte
+
+	// Response is the response in wire format, nil if the query was dropped, if redacted or in privacy mode
+	Response []byte
+
+	// Rcode is the response code of the response
+	Rcode int
+
+	// Questions describes how each question in the query was handled
+	Questions []QuestionLogEntry
+
+	// Upstream is the upstream DNS server that unanswered questions were passed along to, if any
+	Upstream string
+
+	// UpstreamDuration is how long the exchange with Upstream took
+	UpstreamDuration time.Duration
+
+	// Err describes why processing the query failed, if it did
+	Err string
+}
+
+// QuestionLogEntry describes a single question in a QueryLogEntry
+type QuestionLogEntry struct {
+	// Name is the name that was queried, a hash of it in privacy mode (see Options.PrivacyKey) or empty if redacted
+	Name string
+
+	// Type is the type of question, like "A"
+	Type string
+
+	// Outcome is how the question was handled
+	Outcome Outcome
+
+	// FakeIP is the fake IP the question was answered with, if any
+	FakeIP net.IP
+}
+
+// Redaction controls what's left out of query log entries
+type Redaction int
+
+const (
+	// RedactClient leaves out client addresses
+	RedactClient Redaction = 1 << iota
+
+	// RedactNames leaves out queried names. Since the query and response contain the names too, they're left out as
+	// well.
+	RedactNames
+)
+
+// newQueryLogEntry starts a new entry for a query from the given client, or returns nil if queries aren't logged or
+// this one wasn't sampled
+func (s *server) newQueryLogEntry(client net.Addr, protocol string) *QueryLogEntry {
+	if s.opts.QueryLog == nil {
+		return nil
+	}
+	if rate := s.opts.QueryLogSampleRate; rate > 0 && rate < 1 && rand.Float64() >= rate {
+		return nil
+	}
+	return &QueryLogEntry{Time: time.Now(), Client: client, Protocol: protocol}
+}
+
+// logQuestion records how a question was handled in the given entry, which may be nil
+func (entry *QueryLogEntry) logQuestion(question dns.Question, outcome Outcome, answer dns.RR) {
+	if entry == nil {
+		return
+	}
+	q := QuestionLogEntry{Name: question.Name, Type: qtypeString(question.Qtype), Outcome: outcome}
+	switch a := answer.(type) {
+	case *dns.A:
+		q.FakeIP = a.A
+	case *dns.AAAA:
+		q.FakeIP = a.AAAA
+	}
+	entry.Questions = append(entry.Questions, q)
+}
+
+// logQuery finishes the given entry, which may be nil, with the query and response and passes it to the QueryLogger
+func (s *server) logQuery(entry *QueryLogEntry, query []byte, response []byte) {
+	if entry == nil {
+		return
+	}
+	entry.Duration = time.Since(entry.Time)
+	entry.Query = append([]byte(nil), query...)
+	entry.Response = response
+	if len(s.opts.PrivacyKey) > 0 {
+		entry.Query = nil
+		entry.Response = nil
+		for i := range entry.Questions {
+			entry.Questions[i].Name = s.loggableName(entry.Questions[i].Name)
+		}
+	}
+	redaction := s.opts.QueryLogRedaction
+	if redaction&RedactClient != 0 {
+		entry.Client = nil
+	}
+	if redaction&RedactNames != 0 {
+		entry.Query = nil
+		entry.Response = nil
+		for i := range entry.Questions {
+			entry.Questions[i].Name = ""
+		}
+	}
+	s.opts.QueryLog.LogQuery(entry)
+}
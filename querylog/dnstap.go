@@ -0,0 +1,122 @@
+package querylog
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/getlantern/dnsgrab"
+	"google.golang.org/protobuf/proto"
+)
+
+// DnstapWriter is a dnsgrab.QueryLogger that writes entries as dnstap messages in a Frame Streams stream. Every entry
+// becomes a CLIENT_QUERY message followed by a CLIENT_RESPONSE message unless the query was dropped. Details that
+// dnstap has no fields for, like how each question was handled, are included as JSON in the extra field of the last
+// message.
+type DnstapWriter struct {
+	w        dnstap.Writer
+	identity []byte
+	mx       sync.Mutex
+}
+
+// NewDnstap creates a DnstapWriter that writes to w, identifying itself with the given identity, which may be empty.
+// Call Close to finish the stream.
+func NewDnstap(w io.Writer, identity string) (*DnstapWriter, error) {
+	fw, err := dnstap.NewWriter(w, nil)
+	if err != nil {
+		return nil, err
+	}
+	dw := &DnstapWriter{w: fw}
+	if identity != "" {
+		dw.identity = []byte(identity)
+	}
+	return dw, nil
+}
+
+func (w *DnstapWriter) LogQuery(entry *dnsgrab.QueryLogEntry) {
+	extra, err := json.Marshal(toJSONEntry(entry))
+	if err != nil {
+		log.Errorf("Unable to encode query log entry: %v", err)
+		return
+	}
+
+	query := w.message(entry, dnstap.Message_CLIENT_QUERY)
+	setTime(&query.QueryTimeSec, &query.QueryTimeNsec, entry.Time)
+	query.QueryMessage = entry.Query
+	frames := []*dnstap.Message{query}
+	if entry.Response != nil {
+		response := w.message(entry, dnstap.Message_CLIENT_RESPONSE)
+		setTime(&response.QueryTimeSec, &response.QueryTimeNsec, entry.Time)
+		setTime(&response.ResponseTimeSec, &response.ResponseTimeNsec, entry.Time.Add(entry.Duration))
+		response.QueryMessage = entry.Query
+		response.ResponseMessage = entry.Response
+		frames = append(frames, response)
+	}
+
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	for i, msg := range frames {
+		dt := &dnstap.Dnstap{
+			Type:     dnstap.Dnstap_MESSAGE.Enum(),
+			Identity: w.identity,
+			Message:  msg,
+		}
+		if i == len(frames)-1 {
+			dt.Extra = extra
+		}
+		b, err := proto.Marshal(dt)
+		if err != nil {
+			log.Errorf("Unable to encode dnstap message: %v", err)
+			return
+		}
+		if _, err := w.w.WriteFrame(b); err != nil {
+			log.Errorf("Unable to write dnstap message: %v", err)
+			return
+		}
+	}
+}
+
+// Close finishes the stream. It doesn't close the underlying io.Writer.
+func (w *DnstapWriter) Close() error {
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	return w.w.Close()
+}
+
+func (w *DnstapWriter) message(entry *dnsgrab.QueryLogEntry, typ dnstap.Message_Type) *dnstap.Message {
+	msg := &dnstap.Message{Type: typ.Enum()}
+	protocol := dnstap.SocketProtocol_UDP
+	if entry.Protocol == "tcp" {
+		protocol = dnstap.SocketProtocol_TCP
+	}
+	msg.SocketProtocol = protocol.Enum()
+
+	var ip net.IP
+	var port int
+	switch addr := entry.Client.(type) {
+	case *net.UDPAddr:
+		ip, port = addr.IP, addr.Port
+	case *net.TCPAddr:
+		ip, port = addr.IP, addr.Port
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		msg.SocketFamily = dnstap.SocketFamily_INET.Enum()
+		msg.QueryAddress = ip4
+	} else if ip != nil {
+		msg.SocketFamily = dnstap.SocketFamily_INET6.Enum()
+		msg.QueryAddress = ip.To16()
+	}
+	if ip != nil {
+		p := uint32(port)
+		msg.QueryPort = &p
+	}
+	return msg
+}
+
+func setTime(sec **uint64, nsec **uint32, t time.Time) {
+	s, ns := uint64(t.Unix()), uint32(t.Nanosecond())
+	*sec, *nsec = &s, &ns
+}
@@ -0,0 +1,82 @@
+// Package querylog provides dnsgrab.QueryLogger implementations that write query logs as JSON lines or dnstap.
+package querylog
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/getlantern/dns"
+	"github.com/getlantern/dnsgrab"
+	"github.com/getlantern/golog"
+)
+
+var (
+	log = golog.LoggerFor("dnsgrab.querylog")
+)
+
+type jsonEntry struct {
+	Time             time.Time      `json:"time"`
+	DurationMS       float64        `json:"duration_ms"`
+	Client           string         `json:"client,omitempty"`
+	Protocol         string         `json:"protocol,omitempty"`
+	Rcode            string         `json:"rcode"`
+	Questions        []jsonQuestion `json:"questions"`
+	Upstream         string         `json:"upstream,omitempty"`
+	UpstreamDuration float64        `json:"upstream_ms,omitempty"`
+	Error            string         `json:"error,omitempty"`
+}
+
+type jsonQuestion struct {
+	Name    string `json:"name,omitempty"`
+	Type    string `json:"type"`
+	Outcome string `json:"outcome"`
+	FakeIP  net.IP `json:"fake_ip,omitempty"`
+}
+
+func toJSONEntry(entry *dnsgrab.QueryLogEntry) *jsonEntry {
+	je := &jsonEntry{
+		Time:             entry.Time,
+		DurationMS:       milliseconds(entry.Duration),
+		Protocol:         entry.Protocol,
+		Rcode:            dns.RcodeToString[entry.Rcode],
+		Questions:        make([]jsonQuestion, 0, len(entry.Questions)),
+		Upstream:         entry.Upstream,
+		UpstreamDuration: milliseconds(entry.UpstreamDuration),
+		Error:            entry.Err,
+	}
+	if entry.Client != nil {
+		je.Client = entry.Client.String()
+	}
+	for _, q := range entry.Questions {
+		je.Questions = append(je.Questions, jsonQuestion{Name: q.Name, Type: q.Type, Outcome: q.Outcome.String(), FakeIP: q.FakeIP})
+	}
+	return je
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// JSONWriter is a dnsgrab.QueryLogger that writes every entry as a single line of JSON
+type JSONWriter struct {
+	enc *json.Encoder
+	mx  sync.Mutex
+}
+
+// NewJSON creates a JSONWriter that writes to w. Writes aren't buffered, so w should be buffered if it's expensive to
+// write to.
+func NewJSON(w io.Writer) *JSONWriter {
+	return &JSONWriter{enc: json.NewEncoder(w)}
+}
+
+func (w *JSONWriter) LogQuery(entry *dnsgrab.QueryLogEntry) {
+	je := toJSONEntry(entry)
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	if err := w.enc.Encode(je); err != nil {
+		log.Errorf("Unable to write query log entry: %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+package querylog
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/getlantern/dns"
+	"github.com/getlantern/dnsgrab"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func testEntry(t *testing.T) *dnsgrab.QueryLogEntry {
+	q := &dns.Msg{}
+	q.SetQuestion("domain1.", dns.TypeA)
+	query, err := q.Pack()
+	require.NoError(t, err)
+	r := &dns.Msg{}
+	r.SetReply(q)
+	response, err := r.Pack()
+	require.NoError(t, err)
+	return &dnsgrab.QueryLogEntry{
+		Time:     time.Unix(1700000000, 500),
+		Duration: 2 * time.Millisecond,
+		Client:   &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 5353},
+		Protocol: "udp",
+		Query:    query,
+		Response: response,
+		Questions: []dnsgrab.QuestionLogEntry{
+			{Name: "domain1.", Type: "A", Outcome: dnsgrab.OutcomeGrabbed, FakeIP: net.ParseIP("240.0.0.1")},
+		},
+	}
+}
+
+func TestJSON(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewJSON(&buf)
+	w.LogQuery(testEntry(t))
+	w.LogQuery(testEntry(t))
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	require.Len(t, lines, 2)
+	var decoded map[string]interface{}
+	require.NoError(t, json.Unmarshal(lines[0], &decoded))
+	require.Equal(t, "10.0.0.2:5353", decoded["client"])
+	require.Equal(t, "NOERROR", decoded["rcode"])
+	require.EqualValues(t, 2, decoded["duration_ms"])
+	require.Equal(t, []interface{}{map[string]interface{}{
+		"name": "domain1.", "type": "A", "outcome": "grabbed", "fake_ip": "240.0.0.1",
+	}}, decoded["questions"])
+}
+
+func TestDnstap(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewDnstap(&buf, "dnsgrab")
+	require.NoError(t, err)
+	entry := testEntry(t)
+	w.LogQuery(entry)
+	require.NoError(t, w.Close())
+
+	r, err := dnstap.NewReader(&buf, nil)
+	require.NoError(t, err)
+	var frames []*dnstap.Dnstap
+	for {
+		b := make([]byte, 65536)
+		n, err := r.ReadFrame(b)
+		if err != nil {
+			break
+		}
+		dt := &dnstap.Dnstap{}
+		require.NoError(t, proto.Unmarshal(b[:n], dt))
+		frames = append(frames, dt)
+	}
+	require.Len(t, frames, 2)
+
+	query, response := frames[0], frames[1]
+	require.Equal(t, []byte("dnsgrab"), query.Identity)
+	require.Equal(t, dnstap.Message_CLIENT_QUERY, query.Message.GetType())
+	require.Equal(t, entry.Query, query.Message.QueryMessage)
+	require.Equal(t, net.ParseIP("10.0.0.2").To4(), net.IP(query.Message.QueryAddress))
+	require.EqualValues(t, 5353, query.Message.GetQueryPort())
+	require.Equal(t, dnstap.SocketFamily_INET, query.Message.GetSocketFamily())
+	require.Nil(t, query.Extra)
+
+	require.Equal(t, dnstap.Message_CLIENT_RESPONSE, response.Message.GetType())
+	require.Equal(t, entry.Response, response.Message.ResponseMessage)
+	require.EqualValues(t, 1700000000, response.Message.GetQueryTimeSec())
+	require.EqualValues(t, 2000500, response.Message.GetResponseTimeNsec())
+	var extra map[string]interface{}
+	require.NoError(t, json.Unmarshal(response.Extra, &extra))
+	require.Equal(t, "udp", extra["protocol"])
+}
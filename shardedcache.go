@@ -0,0 +1,306 @@
+package dnsgrab
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/dnsgrab/internal"
+)
+
+// ThreadSafeCache is optionally implemented by Caches that are safe for concurrent use. The server doesn't serialize
+// queries against caches whose ThreadSafe returns true, except for making sure that concurrent queries for the same
+// name don't allocate multiple fake IPs.
+type ThreadSafeCache interface {
+	Cache
+
+	// ThreadSafe indicates whether the cache is safe for concurrent use
+	ThreadSafe() bool
+}
+
+// shardedCache is a size bounded in-memory cache that's safe for concurrent use. Names are spread across shards that
+// are locked independently, each of which evicts its own least recently used entries once it holds more than its
+// share of the total size. Lookups don't lock anything. They're served from indexes of IPs by name and names by IP,
+// which are only changed while holding the lock of the shard that the name belongs to.
+type shardedCache struct {
+	shards    []*cacheShard
+	ipsByName sync.Map // string -> uint32
+	namesByIP sync.Map // uint32 -> string
+	sequence  atomic.Uint32
+	onEvicted notifyFuncs
+}
+
+type cacheShard struct {
+	idx      int
+	size     int
+	mappings *internal.Mappings
+	mx       sync.RWMutex
+}
+
+// NewShardedCache creates a Cache holding up to size entries that's safe for concurrent use, spreading entries across
+// the given number of independently locked shards. Since each shard evicts on its own, entries aren't evicted in
+// strict least recently used order across the whole cache.
+func NewShardedCache(size int, shards int) Cache {
+	if shards < 1 {
+		shards = 1
+	}
+	cache := &shardedCache{shards: make([]*cacheShard, shards)}
+	shardSize := (size + shards - 1) / shards
+	for i := range cache.shards {
+		cache.shards[i] = &cacheShard{idx: i, size: shardSize, mappings: internal.NewMappings()}
+	}
+	cache.sequence.Store(internal.MinIP)
+	return cache
+}
+
+func (cache *shardedCache) ThreadSafe() bool {
+	return true
+}
+
+func (cache *shardedCache) OnEvicted(fn func(name string, ip []byte)) {
+	cache.onEvicted.add(fn)
+}
+
+func (cache *shardedCache) shardFor(name string) *cacheShard {
+	return cache.shards[hashName(name)%uint32(len(cache.shards))]
+}
+
+// shardForIP returns the shard of the name that the given IP is mapped to, or nil if it isn't mapped
+func (cache *shardedCache) shardForIP(ip uint32) *cacheShard {
+	name, found := cache.namesByIP.Load(ip)
+	if !found {
+		return nil
+	}
+	return cache.shardFor(name.(string))
+}
+
+// unindex removes the given mapping from the lookup indexes. Must be called with the lock of the mapping's shard held.
+func (cache *shardedCache) unindex(mapping *internal.Mapping) {
+	cache.ipsByName.CompareAndDelete(mapping.Name, mapping.IP)
+	cache.namesByIP.CompareAndDelete(mapping.IP, mapping.Name)
+}
+
+func (cache *shardedCache) NameByIP(ip []byte) (name string, found bool, err error) {
+	_name, found := cache.namesByIP.Load(internal.IPToInt(ip))
+	if !found {
+		return "", false, nil
+	}
+	return _name.(string), true, nil
+}
+
+func (cache *shardedCache) IPByName(name string) (ip []byte, found bool, err error) {
+	_ip, found := cache.ipsByName.Load(name)
+	if !found {
+		return nil, false, nil
+	}
+	return internal.IntToIP(_ip.(uint32)), true, nil
+}
+
+func (cache *shardedCache) Add(name string, ip []byte) error {
+	return cache.Restore(name, ip, time.Now())
+}
+
+func (cache *shardedCache) Restore(name string, ip []byte, fresh time.Time) error {
+	ipInt := internal.IPToInt(ip)
+	shard := cache.shardFor(name)
+	var owner *cacheShard
+	for {
+		// the IP may currently belong to a name in a different shard, in which case both need to be locked
+		owner = cache.shardForIP(ipInt)
+		cache.lockPair(shard, owner)
+		if current := cache.shardForIP(ipInt); current != owner {
+			// IP moved while we were locking, try again
+			cache.unlockPair(shard, owner)
+			continue
+		}
+		if owner == nil {
+			if _, loaded := cache.namesByIP.LoadOrStore(ipInt, name); loaded {
+				// someone else claimed the IP while we were locking, try again
+				cache.unlockPair(shard, owner)
+				continue
+			}
+		}
+		break
+	}
+
+	if owner != nil {
+		if mapping, found := owner.mappings.ByIP(ipInt); found && mapping.Name != name {
+			// IP is being reassigned after the sequence wrapped around, drop the previous mapping
+			owner.mappings.Remove(mapping)
+			cache.unindex(mapping)
+		}
+	}
+	if mapping, found := shard.mappings.ByName(name); found && mapping.IP != ipInt {
+		// name is being remapped, drop its previous IP
+		shard.mappings.Remove(mapping)
+		cache.unindex(mapping)
+	}
+	shard.mappings.Put(name, ipInt, fresh)
+	cache.ipsByName.Store(name, ipInt)
+	cache.namesByIP.Store(ipInt, name)
+
+	// remove oldest from LRU list if necessary
+	var evicted []*internal.Mapping
+	for shard.mappings.Len() > shard.size {
+		oldest, _ := shard.mappings.Oldest()
+		shard.mappings.Remove(oldest)
+		cache.unindex(oldest)
+		evicted = append(evicted, oldest)
+	}
+	cache.unlockPair(shard, owner)
+
+	for _, mapping := range evicted {
+		cache.onEvicted.notify(mapping.Name, internal.IntToIP(mapping.IP))
+	}
+	return nil
+}
+
+// lockPair locks the given shards in a consistent order so that concurrent callers can't deadlock. other may be nil or
+// the same as shard.
+func (cache *shardedCache) lockPair(shard, other *cacheShard) {
+	if other == nil || other == shard {
+		shard.mx.Lock()
+		return
+	}
+	if other.idx < shard.idx {
+		shard, other = other, shard
+	}
+	shard.mx.Lock()
+	other.mx.Lock()
+}
+
+func (cache *shardedCache) unlockPair(shard, other *cacheShard) {
+	shard.mx.Unlock()
+	if other != nil && other != shard {
+		other.mx.Unlock()
+	}
+}
+
+func (cache *shardedCache) MarkFresh(name string, ip []byte) error {
+	shard := cache.shardFor(name)
+	shard.mx.Lock()
+	defer shard.mx.Unlock()
+	if mapping, found := shard.mappings.ByName(name); found && mapping.IP == internal.IPToInt(ip) {
+		shard.mappings.Touch(mapping)
+	}
+	return nil
+}
+
+func (cache *shardedCache) Remove(name string) (ip []byte, found bool, err error) {
+	shard := cache.shardFor(name)
+	shard.mx.Lock()
+	defer shard.mx.Unlock()
+	mapping, found := shard.mappings.ByName(name)
+	if !found {
+		return nil, false, nil
+	}
+	shard.mappings.Remove(mapping)
+	cache.unindex(mapping)
+	return internal.IntToIP(mapping.IP), true, nil
+}
+
+func (cache *shardedCache) RemoveIP(ip []byte) (name string, found bool, err error) {
+	ipInt := internal.IPToInt(ip)
+	for {
+		shard := cache.shardForIP(ipInt)
+		if shard == nil {
+			return "", false, nil
+		}
+		shard.mx.Lock()
+		if cache.shardForIP(ipInt) != shard {
+			// IP moved while we were locking, try again
+			shard.mx.Unlock()
+			continue
+		}
+		mapping, found := shard.mappings.ByIP(ipInt)
+		if found {
+			shard.mappings.Remove(mapping)
+			cache.unindex(mapping)
+			name = mapping.Name
+		}
+		shard.mx.Unlock()
+		return name, found, nil
+	}
+}
+
+func (cache *shardedCache) Flush() error {
+	for _, shard := range cache.shards {
+		shard.mx.Lock()
+	}
+	for _, shard := range cache.shards {
+		shard.mappings.Reset()
+	}
+	cache.ipsByName.Range(func(name, _ interface{}) bool {
+		cache.ipsByName.Delete(name)
+		return true
+	})
+	cache.namesByIP.Range(func(ip, _ interface{}) bool {
+		cache.namesByIP.Delete(ip)
+		return true
+	})
+	for _, shard := range cache.shards {
+		shard.mx.Unlock()
+	}
+	return nil
+}
+
+// Range visits a consistent snapshot of all entries from most to least recently used
+func (cache *shardedCache) Range(fn func(name string, ip []byte, fresh time.Time) bool) error {
+	var mappings []internal.Mapping
+	for _, shard := range cache.shards {
+		shard.mx.RLock()
+	}
+	for _, shard := range cache.shards {
+		shard.mappings.Range(func(mapping *internal.Mapping) bool {
+			mappings = append(mappings, *mapping)
+			return true
+		})
+	}
+	for _, shard := range cache.shards {
+		shard.mx.RUnlock()
+	}
+
+	sort.SliceStable(mappings, func(i, j int) bool {
+		return mappings[i].Fresh.After(mappings[j].Fresh)
+	})
+	for _, mapping := range mappings {
+		if !fn(mapping.Name, internal.IntToIP(mapping.IP), mapping.Fresh) {
+			break
+		}
+	}
+	return nil
+}
+
+func (cache *shardedCache) Sequence() (uint32, error) {
+	return cache.sequence.Load(), nil
+}
+
+func (cache *shardedCache) SetSequence(next uint32) error {
+	cache.sequence.Store(next)
+	return nil
+}
+
+func (cache *shardedCache) NextSequence() (uint32, error) {
+	for {
+		next := cache.sequence.Load()
+		following := next + 1
+		if following > internal.MaxIP {
+			// wrap IP to stay within allowed range
+			following = internal.MinIP
+		}
+		if cache.sequence.CompareAndSwap(next, following) {
+			return next, nil
+		}
+	}
+}
+
+// hashName hashes a name using 32 bit FNV-1a
+func hashName(name string) uint32 {
+	hash := uint32(2166136261)
+	for i := 0; i < len(name); i++ {
+		hash ^= uint32(name[i])
+		hash *= 16777619
+	}
+	return hash
+}
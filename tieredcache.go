@@ -0,0 +1,337 @@
+package dnsgrab
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// writeBehindQueueSize is how many changes a write-behind TieredCache buffers before callers block
+	writeBehindQueueSize = 1024
+)
+
+// TieredCache is a Cache that serves lookups from a size bounded in-memory cache in front of a backing Cache, usually
+// a persistent one. Lookups that miss the in-memory tier fall through to the backing Cache, which is authoritative
+// for the sequence and for all mappings.
+//
+// Changes are applied to the in-memory tier immediately and to the backing Cache either synchronously (write-through)
+// or asynchronously in order (write-behind). With write-behind, changes don't fail because of errors from the backing
+// Cache, since they were already applied to the in-memory tier. Instead, Degraded indicates whether writing behind
+// fails and Close returns the first error from writing behind. Lookups that miss the in-memory tier as well as Remove,
+// RemoveIP, Flush and Range wait for pending changes to be written first.
+//
+// Entries that the backing Cache evicts or expires are dropped from the in-memory tier and reported to the handlers
+// registered with OnEvicted and OnExpired. Entries that the backing Cache lost without reporting it are added to it
+// again when they're marked fresh, unless their IP was reassigned in the meantime, in which case they're dropped from
+// the in-memory tier. TieredCache is safe for concurrent use if the backing Cache is.
+type TieredCache struct {
+	front       *inMemoryCache
+	back        Cache
+	writeBehind bool
+	queue       chan writeBehindOp
+	stopped     chan interface{}
+	onEvicted   notifyFuncs
+	onExpired   notifyFuncs
+	mx          sync.Mutex
+
+	// entries dropped by the backing Cache, which are removed from the in-memory tier with the next operation. These
+	// are tracked separately because the backing Cache may report them while holding its own lock, so taking mx
+	// could deadlock.
+	dropped   []Entry
+	droppedMx sync.Mutex
+
+	// writeErr is the first error from writing behind that hasn't been returned by Close yet and degraded indicates
+	// whether the last write behind failed. Both are guarded by droppedMx.
+	writeErr error
+	degraded bool
+}
+
+// writeBehindOp is either a change to write behind or, if fn is nil, a signal that all earlier changes were written,
+// which closes drained
+type writeBehindOp struct {
+	fn      func() error
+	drained chan interface{}
+}
+
+// NewTieredCache creates a TieredCache holding up to size entries in memory in front of the given backing Cache and
+// warms the in-memory tier with the freshest entries from the backing Cache.
+func NewTieredCache(size int, back Cache, writeBehind bool) (*TieredCache, error) {
+	cache := &TieredCache{
+		front:       NewInMemoryCache(size).(*inMemoryCache),
+		back:        back,
+		writeBehind: writeBehind,
+	}
+
+	var entries []Entry
+	err := back.Range(func(name string, ip []byte, fresh time.Time) bool {
+		entries = append(entries, Entry{Name: name, IP: copyIP(ip), Fresh: fresh})
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Fresh.After(entries[j].Fresh)
+	})
+	if len(entries) > size {
+		entries = entries[:size]
+	}
+	// restore from least to most recently used, which is cheapest
+	for i := len(entries) - 1; i >= 0; i-- {
+		cache.front.Restore(entries[i].Name, entries[i].IP, entries[i].Fresh)
+	}
+
+	if notifier, ok := back.(EvictionNotifier); ok {
+		notifier.OnEvicted(func(name string, ip []byte) {
+			cache.drop(name, ip)
+			cache.onEvicted.notify(name, ip)
+		})
+	}
+	if notifier, ok := back.(ExpirationNotifier); ok {
+		notifier.OnExpired(func(name string, ip []byte) {
+			cache.drop(name, ip)
+			cache.onExpired.notify(name, ip)
+		})
+	}
+
+	if writeBehind {
+		cache.queue = make(chan writeBehindOp, writeBehindQueueSize)
+		cache.stopped = make(chan interface{})
+		go cache.writeBehindLoop()
+	}
+	return cache, nil
+}
+
+// ThreadSafe indicates whether the TieredCache is safe for concurrent use, which is the case if the backing Cache is
+func (cache *TieredCache) ThreadSafe() bool {
+	threadSafe, ok := cache.back.(ThreadSafeCache)
+	return ok && threadSafe.ThreadSafe()
+}
+
+// OnEvicted registers a function that gets called whenever the backing Cache evicts an entry
+func (cache *TieredCache) OnEvicted(fn func(name string, ip []byte)) {
+	cache.onEvicted.add(fn)
+}
+
+// OnExpired registers a function that gets called whenever the backing Cache expires an entry
+func (cache *TieredCache) OnExpired(fn func(name string, ip []byte)) {
+	cache.onExpired.add(fn)
+}
+
+// Close writes any pending changes to the backing Cache and closes it if it's an io.Closer
+func (cache *TieredCache) Close() error {
+	cache.mx.Lock()
+	defer cache.mx.Unlock()
+	if cache.writeBehind {
+		close(cache.queue)
+		<-cache.stopped
+		cache.writeBehind = false
+	}
+	err := cache.takeWriteErr()
+	if closer, ok := cache.back.(io.Closer); ok {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func (cache *TieredCache) NameByIP(ip []byte) (name string, found bool, err error) {
+	cache.lock()
+	defer cache.mx.Unlock()
+	name, found, _ = cache.front.NameByIP(ip)
+	if found {
+		return name, true, nil
+	}
+	cache.drain()
+	name, found, err = cache.back.NameByIP(ip)
+	if found && err == nil {
+		cache.front.Add(name, copyIP(ip))
+	}
+	return
+}
+
+func (cache *TieredCache) IPByName(name string) (ip []byte, found bool, err error) {
+	cache.lock()
+	defer cache.mx.Unlock()
+	ip, found, _ = cache.front.IPByName(name)
+	if found {
+		return ip, true, nil
+	}
+	cache.drain()
+	ip, found, err = cache.back.IPByName(name)
+	if found && err == nil {
+		cache.front.Add(name, copyIP(ip))
+	}
+	return
+}
+
+func (cache *TieredCache) Add(name string, ip []byte) error {
+	return cache.Restore(name, ip, time.Now())
+}
+
+func (cache *TieredCache) Restore(name string, ip []byte, fresh time.Time) error {
+	cache.lock()
+	defer cache.mx.Unlock()
+	ip = copyIP(ip)
+	cache.front.Restore(name, ip, fresh)
+	return cache.write(func() error {
+		return cache.back.Restore(name, ip, fresh)
+	})
+}
+
+func (cache *TieredCache) MarkFresh(name string, ip []byte) error {
+	cache.lock()
+	defer cache.mx.Unlock()
+	ip = copyIP(ip)
+	if current, found, _ := cache.front.NameByIP(ip); found && current == name {
+		cache.front.MarkFresh(name, ip)
+	}
+	return cache.write(func() error {
+		current, found, err := cache.back.NameByIP(ip)
+		switch {
+		case err != nil:
+			return err
+		case !found:
+			// the backing Cache lost the entry without telling us, for example because it expired before being swept
+			return cache.back.Add(name, ip)
+		case current != name:
+			// the IP was reassigned, so the entry in the in-memory tier is stale
+			cache.drop(name, ip)
+			return nil
+		default:
+			return cache.back.MarkFresh(name, ip)
+		}
+	})
+}
+
+func (cache *TieredCache) Remove(name string) (ip []byte, found bool, err error) {
+	cache.lock()
+	defer cache.mx.Unlock()
+	frontIP, frontFound, _ := cache.front.Remove(name)
+	cache.drain()
+	ip, found, err = cache.back.Remove(name)
+	if !found && err == nil {
+		return frontIP, frontFound, nil
+	}
+	return
+}
+
+func (cache *TieredCache) RemoveIP(ip []byte) (name string, found bool, err error) {
+	cache.lock()
+	defer cache.mx.Unlock()
+	frontName, frontFound, _ := cache.front.RemoveIP(ip)
+	cache.drain()
+	name, found, err = cache.back.RemoveIP(ip)
+	if !found && err == nil {
+		return frontName, frontFound, nil
+	}
+	return
+}
+
+func (cache *TieredCache) Flush() error {
+	cache.lock()
+	defer cache.mx.Unlock()
+	cache.front.Flush()
+	cache.drain()
+	return cache.back.Flush()
+}
+
+// Range ranges over the entries of the backing Cache
+func (cache *TieredCache) Range(fn func(name string, ip []byte, fresh time.Time) bool) error {
+	cache.lock()
+	defer cache.mx.Unlock()
+	cache.drain()
+	return cache.back.Range(fn)
+}
+
+func (cache *TieredCache) NextSequence() (uint32, error) {
+	return cache.back.NextSequence()
+}
+
+func (cache *TieredCache) Sequence() (uint32, error) {
+	return cache.back.Sequence()
+}
+
+func (cache *TieredCache) SetSequence(next uint32) error {
+	return cache.back.SetSequence(next)
+}
+
+// lock locks the cache and removes entries that the backing Cache dropped from the in-memory tier
+func (cache *TieredCache) lock() {
+	cache.mx.Lock()
+	cache.droppedMx.Lock()
+	dropped := cache.dropped
+	cache.dropped = nil
+	cache.droppedMx.Unlock()
+	for _, entry := range dropped {
+		// only remove the entry if it hasn't been remapped in the meantime
+		if name, found, _ := cache.front.NameByIP(entry.IP); found && name == entry.Name {
+			cache.front.RemoveIP(entry.IP)
+		}
+	}
+}
+
+func (cache *TieredCache) drop(name string, ip []byte) {
+	cache.droppedMx.Lock()
+	cache.dropped = append(cache.dropped, Entry{Name: name, IP: copyIP(ip)})
+	cache.droppedMx.Unlock()
+}
+
+// write applies a change to the backing Cache, either immediately or by queueing it, in which case it doesn't fail.
+// Must be called with mx held.
+func (cache *TieredCache) write(fn func() error) error {
+	if !cache.writeBehind {
+		return fn()
+	}
+	cache.queue <- writeBehindOp{fn: fn}
+	return nil
+}
+
+// Degraded indicates whether the last change written behind to the backing Cache failed
+func (cache *TieredCache) Degraded() bool {
+	cache.droppedMx.Lock()
+	defer cache.droppedMx.Unlock()
+	return cache.degraded
+}
+
+// takeWriteErr returns the first error from writing behind that hasn't been returned yet
+func (cache *TieredCache) takeWriteErr() error {
+	cache.droppedMx.Lock()
+	defer cache.droppedMx.Unlock()
+	err := cache.writeErr
+	cache.writeErr = nil
+	return err
+}
+
+// drain waits for all queued changes to be written to the backing Cache. Must be called with mx held.
+func (cache *TieredCache) drain() {
+	if !cache.writeBehind {
+		return
+	}
+	drained := make(chan interface{})
+	cache.queue <- writeBehindOp{drained: drained}
+	<-drained
+}
+
+func (cache *TieredCache) writeBehindLoop() {
+	defer close(cache.stopped)
+	for op := range cache.queue {
+		if op.fn == nil {
+			close(op.drained)
+			continue
+		}
+		err := op.fn()
+		if err != nil {
+			log.Errorf("Unable to write change to backing cache: %v", err)
+		}
+		cache.droppedMx.Lock()
+		if err != nil && cache.writeErr == nil {
+			cache.writeErr = err
+		}
+		cache.degraded = err != nil
+		cache.droppedMx.Unlock()
+	}
+}
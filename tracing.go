@@ -0,0 +1,46 @@
+package dnsgrab
+
+import (
+	"context"
+
+	"github.com/getlantern/dns"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName = "github.com/getlantern/dnsgrab"
+
+	attrQuestionName  = attribute.Key("dns.question.name")
+	attrQuestionType  = attribute.Key("dns.question.type")
+	attrQuestionCount = attribute.Key("dns.question.count")
+	attrAnswerCount   = attribute.Key("dns.answer.count")
+	attrOutcome       = attribute.Key("dnsgrab.outcome")
+	attrCacheResult   = attribute.Key("dnsgrab.cache.result")
+	attrUpstream      = attribute.Key("server.address")
+)
+
+// startQuestionSpan starts a span for processing a single question
+func (s *server) startQuestionSpan(ctx context.Context, question dns.Question) (context.Context, trace.Span) {
+	return s.tracer.Start(ctx, "dnsgrab.question", trace.WithAttributes(
+		attrQuestionName.String(s.loggableName(question.Name)),
+		attrQuestionType.String(qtypeString(question.Qtype)),
+	))
+}
+
+// cacheLookedUp records the result of checking the cache for an existing fake IP in metrics and on the current span
+func (s *server) cacheLookedUp(ctx context.Context, hit bool) {
+	s.metrics.CacheLookedUp(hit)
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attrCacheResult.String(result))
+}
+
+// recordError marks the given span as failed
+func recordError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -0,0 +1,70 @@
+package dnsgrab
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/getlantern/dns"
+)
+
+const (
+	// dnsHeaderLen is the length of the fixed DNS message header
+	dnsHeaderLen = 12
+
+	// maxQuestions is the maximum number of questions accepted in a single query. Clients practically always send
+	// only one, so anything beyond a few is most likely an attempt to amplify the work done per query.
+	maxQuestions = 4
+)
+
+var (
+	// ErrInvalidQuery means that a message passed to ProcessQuery can't be answered at all, either because it's too
+	// short to contain a DNS header or because it's a response rather than a query. Answering responses could set off
+	// loops between servers, so such messages are dropped.
+	ErrInvalidQuery = errors.New("invalid query")
+)
+
+// validateQuery parses and validates the given query. If the query can't be answered at all, it returns an error
+// wrapping ErrInvalidQuery. If it can be answered but not processed, it returns the response code to answer with,
+// FORMERR for malformed queries and NOTIMP for opcodes other than QUERY, along with a message holding whatever of the
+// query could be parsed.
+func validateQuery(b []byte) (*dns.Msg, int, error) {
+	// check the header directly, since the rest of the message may not parse
+	if err := checkHeader(b); err != nil {
+		return nil, 0, err
+	}
+	flags := binary.BigEndian.Uint16(b[2:])
+	header := &dns.Msg{}
+	header.Id = binary.BigEndian.Uint16(b)
+	header.Opcode = int(flags>>11) & 0xf
+	header.RecursionDesired = flags&(1<<8) != 0
+	if header.Opcode != dns.OpcodeQuery {
+		return header, dns.RcodeNotImplemented, nil
+	}
+
+	msgIn := &dns.Msg{}
+	if err := msgIn.Unpack(b); err != nil {
+		return header, dns.RcodeFormatError, nil
+	}
+	if len(msgIn.Question) == 0 || len(msgIn.Question) > maxQuestions {
+		return header, dns.RcodeFormatError, nil
+	}
+	for _, question := range msgIn.Question {
+		if len(normalizeName(question.Name)) > maxNameLength {
+			return header, dns.RcodeFormatError, nil
+		}
+	}
+	return msgIn, dns.RcodeSuccess, nil
+}
+
+// checkHeader makes sure that b is long enough to hold a DNS header and doesn't have the QR bit set, returning an
+// error wrapping ErrInvalidQuery if not
+func checkHeader(b []byte) error {
+	if len(b) < dnsHeaderLen {
+		return fmt.Errorf("%w: truncated header", ErrInvalidQuery)
+	}
+	if binary.BigEndian.Uint16(b[2:])&(1<<15) != 0 {
+		return fmt.Errorf("%w: message is a response", ErrInvalidQuery)
+	}
+	return nil
+}